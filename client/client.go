@@ -2,12 +2,16 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+
+	"github.com/enolgor/go-utils-mm/client/trace"
 )
 
 type Request struct {
@@ -17,14 +21,34 @@ type Request struct {
 	body    any
 	length  int64
 	form    *url.Values
+	ctx     context.Context
+	doer    Doer
+}
+
+type Doer func(*http.Request) (*http.Response, error)
+type Interceptor func(next Doer) Doer
+
+var interceptorsMu sync.RWMutex
+var interceptors []Interceptor = []Interceptor{}
+
+// Intercept registers an interceptor wrapping every request sent with Do,
+// interceptors registered first run outermost.
+func Intercept(interceptor Interceptor) {
+	interceptorsMu.Lock()
+	defer interceptorsMu.Unlock()
+	interceptors = append(interceptors, interceptor)
+}
+
+func NewRequest(method, url string) *Request {
+	return &Request{method, url, map[string]string{}, nil, 0, nil, context.Background(), nil}
 }
 
 func Get(url string) *Request {
-	return &Request{"GET", url, map[string]string{}, nil, 0, nil}
+	return NewRequest("GET", url)
 }
 
 func Post(url string) *Request {
-	return &Request{"POST", url, map[string]string{}, nil, 0, nil}
+	return NewRequest("POST", url)
 }
 
 func (r *Request) WithHeader(key, value string) *Request {
@@ -39,6 +63,18 @@ func (r *Request) WithHeaders(headers map[string]string) *Request {
 	return r
 }
 
+func (r *Request) WithContext(ctx context.Context) *Request {
+	r.ctx = ctx
+	return r
+}
+
+// WithDoer sends the request with doer instead of http.DefaultClient,
+// interceptors still apply.
+func (r *Request) WithDoer(doer Doer) *Request {
+	r.doer = doer
+	return r
+}
+
 func (r *Request) WithBody(body any) *Request {
 	if r.method == "GET" {
 		return r
@@ -107,12 +143,24 @@ func (r *Request) Do() (*http.Response, error) {
 	if _, ok := r.headers[ContentType]; !ok {
 		r.headers[ContentType] = contentType
 	}
-	req, err := http.NewRequest(r.method, r.url, body)
+	req, err := http.NewRequestWithContext(r.ctx, r.method, r.url, body)
 	if err != nil {
 		return nil, err
 	}
 	for k, v := range r.headers {
 		req.Header.Add(k, v)
 	}
-	return http.DefaultClient.Do(req)
+	if req.Header.Get(trace.TraceparentHeader) == "" {
+		trace.Inject(r.ctx, req.Header)
+	}
+	interceptorsMu.RLock()
+	do := Doer(http.DefaultClient.Do)
+	if r.doer != nil {
+		do = r.doer
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		do = interceptors[i](do)
+	}
+	interceptorsMu.RUnlock()
+	return do(req)
 }
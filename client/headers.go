@@ -63,24 +63,32 @@ const (
 	Upgrade                       = "Upgrade"
 	Vary                          = "Vary"
 	WWWAuthenticate               = "WWW-Authenticate"
+	ReferrerPolicy                = "Referrer-Policy"
+	PermissionsPolicy             = "Permissions-Policy"
+	Forwarded                     = "Forwarded"
 
 	// Non-Standard
-	XFrameOptions          = "X-Frame-Options"
-	XXSSProtection         = "X-XSS-Protection"
-	ContentSecurityPolicy  = "Content-Security-Policy"
-	XContentSecurityPolicy = "X-Content-Security-Policy"
-	XWebKitCSP             = "X-WebKit-CSP"
-	XContentTypeOptions    = "X-Content-Type-Options"
-	XPoweredBy             = "X-Powered-By"
-	XUACompatible          = "X-UA-Compatible"
-	XForwardedProto        = "X-Forwarded-Proto"
-	XHTTPMethodOverride    = "X-HTTP-Method-Override"
-	XForwardedFor          = "X-Forwarded-For"
-	XRealIP                = "X-Real-IP"
-	XCSRFToken             = "X-CSRF-Token"
-	XRatelimitLimit        = "X-Ratelimit-Limit"
-	XRatelimitRemaining    = "X-Ratelimit-Remaining"
-	XRatelimitReset        = "X-Ratelimit-Reset"
+	XFrameOptions                   = "X-Frame-Options"
+	XXSSProtection                  = "X-XSS-Protection"
+	ContentSecurityPolicy           = "Content-Security-Policy"
+	ContentSecurityPolicyReportOnly = "Content-Security-Policy-Report-Only"
+	XContentSecurityPolicy          = "X-Content-Security-Policy"
+	XWebKitCSP                      = "X-WebKit-CSP"
+	XContentTypeOptions             = "X-Content-Type-Options"
+	XPoweredBy                      = "X-Powered-By"
+	XUACompatible                   = "X-UA-Compatible"
+	XForwardedProto                 = "X-Forwarded-Proto"
+	XHTTPMethodOverride             = "X-HTTP-Method-Override"
+	XForwardedFor                   = "X-Forwarded-For"
+	XForwardedHost                  = "X-Forwarded-Host"
+	XRealIP                         = "X-Real-IP"
+	XRequestID                      = "X-Request-Id"
+	XCSRFToken                      = "X-CSRF-Token"
+	XRatelimitLimit                 = "X-Ratelimit-Limit"
+	XRatelimitRemaining             = "X-Ratelimit-Remaining"
+	XRatelimitReset                 = "X-Ratelimit-Reset"
+	IdempotencyKey                  = "Idempotency-Key"
+	IdempotentReplayed              = "Idempotent-Replayed"
 )
 
 // Normalize formats the input header to the formation of "Xxx-Xxx".
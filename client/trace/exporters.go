@@ -0,0 +1,205 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+type ExporterFunc func(ctx context.Context, spans []*Span) error
+
+func (f ExporterFunc) Export(ctx context.Context, spans []*Span) error {
+	return f(ctx, spans)
+}
+
+func LogExporter(logger *slog.Logger) Exporter {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return ExporterFunc(func(ctx context.Context, spans []*Span) error {
+		for _, span := range spans {
+			attrs := []slog.Attr{
+				slog.String("trace_id", span.TraceID.String()),
+				slog.String("span_id", span.SpanID.String()),
+				slog.Duration("duration", span.EndTime.Sub(span.StartTime)),
+			}
+			if span.ParentID.IsValid() {
+				attrs = append(attrs, slog.String("parent_id", span.ParentID.String()))
+			}
+			if span.Status == StatusError {
+				attrs = append(attrs, slog.String("error", span.StatusMessage))
+			}
+			if len(span.Attributes) > 0 {
+				group := make([]any, 0, len(span.Attributes))
+				for k, v := range span.Attributes {
+					group = append(group, slog.Any(k, v))
+				}
+				attrs = append(attrs, slog.Group("attributes", group...))
+			}
+			logger.LogAttrs(ctx, slog.LevelInfo, span.Name, attrs...)
+		}
+		return nil
+	})
+}
+
+// FileExporter appends spans to path, one JSON object per line.
+func FileExporter(path string) (Exporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	return ExporterFunc(func(ctx context.Context, spans []*Span) error {
+		mu.Lock()
+		defer mu.Unlock()
+		enc := json.NewEncoder(f)
+		for _, span := range spans {
+			if err := enc.Encode(span); err != nil {
+				return err
+			}
+		}
+		return nil
+	}), nil
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    StatusCode `json:"code,omitempty"`
+		Message string     `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(key string, value any) otlpAttribute {
+	attr := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case bool:
+		attr.Value.BoolValue = &v
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		attr.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		attr.Value.IntValue = &s
+	case float64:
+		attr.Value.DoubleValue = &v
+	case string:
+		attr.Value.StringValue = &v
+	default:
+		s := fmt.Sprint(v)
+		attr.Value.StringValue = &s
+	}
+	return attr
+}
+
+func otlpPayload(spans []*Span) otlpRequest {
+	byService := map[string][]otlpSpan{}
+	services := []string{}
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			TraceState:        span.context.State,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		}
+		if span.ParentID.IsValid() {
+			s.ParentSpanID = span.ParentID.String()
+		}
+		for k, v := range span.Attributes {
+			s.Attributes = append(s.Attributes, otlpAttr(k, v))
+		}
+		s.Status.Code = span.Status
+		s.Status.Message = span.StatusMessage
+		if _, ok := byService[span.Service]; !ok {
+			services = append(services, span.Service)
+		}
+		byService[span.Service] = append(byService[span.Service], s)
+	}
+	payload := otlpRequest{}
+	for _, service := range services {
+		rs := otlpResourceSpans{}
+		rs.Resource.Attributes = []otlpAttribute{otlpAttr("service.name", service)}
+		scope := otlpScopeSpans{Spans: byService[service]}
+		scope.Scope.Name = "github.com/enolgor/go-utils-mm/client/trace"
+		rs.ScopeSpans = []otlpScopeSpans{scope}
+		payload.ResourceSpans = append(payload.ResourceSpans, rs)
+	}
+	return payload
+}
+
+// OTLPExporter sends spans to an OTLP/HTTP collector using the JSON encoding,
+// endpoint is the full traces url, usually http://collector:4318/v1/traces.
+func OTLPExporter(endpoint string, headers map[string]string) Exporter {
+	return ExporterFunc(func(ctx context.Context, spans []*Span) error {
+		body, err := json.Marshal(otlpPayload(spans))
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("otlp export failed with status %d", resp.StatusCode)
+		}
+		return nil
+	})
+}
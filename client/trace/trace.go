@@ -0,0 +1,385 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TraceparentHeader = "Traceparent"
+	TracestateHeader  = "Tracestate"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+func (id SpanID) IsValid() bool  { return id != SpanID{} }
+
+func (id TraceID) MarshalText() ([]byte, error) { return []byte(id.String()), nil }
+func (id SpanID) MarshalText() ([]byte, error)  { return []byte(id.String()), nil }
+
+func newTraceID() (id TraceID) {
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return
+}
+
+func newSpanID() (id SpanID) {
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return
+}
+
+const flagSampled byte = 0x01
+
+// SpanContext is the part of a span propagated across services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	State   string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTraceparent parses a traceparent header value. Versions above 00 are
+// accepted as long as they start with the version 00 fields.
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+	value = strings.TrimSpace(value)
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+	for _, part := range parts[:4] {
+		if !isLowerHex(part) {
+			return sc, fmt.Errorf("invalid traceparent %q", value)
+		}
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+	hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	flags, _ := hex.DecodeString(parts[3])
+	sc.Flags = flags[0]
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+	return sc, nil
+}
+
+// Extract reads the span context propagated in header, the second value is
+// false when there is none or it is invalid.
+func Extract(header http.Header) (SpanContext, bool) {
+	sc, err := ParseTraceparent(header.Get(TraceparentHeader))
+	if err != nil {
+		return SpanContext{}, false
+	}
+	sc.State = strings.Join(header.Values(TracestateHeader), ",")
+	return sc, true
+}
+
+// Inject writes the span context of ctx to header, it does nothing when ctx
+// carries no span context.
+func Inject(ctx context.Context, header http.Header) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		return
+	}
+	header.Set(TraceparentHeader, sc.Traceparent())
+	if sc.State != "" {
+		header.Set(TracestateHeader, sc.State)
+	} else {
+		header.Del(TracestateHeader)
+	}
+}
+
+type SpanKind int
+
+const (
+	KindInternal SpanKind = iota + 1
+	KindServer
+	KindClient
+)
+
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = iota
+	StatusOK
+	StatusError
+)
+
+type Span struct {
+	Name          string         `json:"name"`
+	Kind          SpanKind       `json:"kind"`
+	Service       string         `json:"service"`
+	TraceID       TraceID        `json:"trace_id"`
+	SpanID        SpanID         `json:"span_id"`
+	ParentID      SpanID         `json:"parent_id"`
+	StartTime     time.Time      `json:"start"`
+	EndTime       time.Time      `json:"end"`
+	Attributes    map[string]any `json:"attributes,omitempty"`
+	Status        StatusCode     `json:"status"`
+	StatusMessage string         `json:"status_message,omitempty"`
+
+	context SpanContext
+	tracer  *Tracer
+	mu      sync.Mutex
+	ended   bool
+}
+
+func (s *Span) SpanContext() SpanContext {
+	return s.context
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = map[string]any{}
+	}
+	s.Attributes[key] = value
+}
+
+func (s *Span) SetStatus(code StatusCode, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status = code
+	s.StatusMessage = message
+}
+
+// End records the end time of the span and queues it for export, only the
+// first call has any effect.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+	if s.tracer != nil && s.context.Sampled() {
+		s.tracer.enqueue(s)
+	}
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey, span)
+}
+
+// ContextWithRemote stores a span context received from another service, it
+// becomes the parent of the next span started from ctx.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// SpanContextFromContext returns the span context of the current span, or the
+// remote one when no span was started yet.
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.context, true
+	}
+	sc, ok := ctx.Value(remoteKey).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+}
+
+type TracerOptions struct {
+	// SampleRoot decides if traces started here are recorded, all of them
+	// are when nil. Child spans follow the decision of their parent.
+	SampleRoot func() bool
+	BatchSize  int
+	Interval   time.Duration
+	QueueSize  int
+}
+
+// Tracer creates spans and exports the finished ones in batches from a
+// background goroutine, stopped by Shutdown.
+type Tracer struct {
+	service  string
+	exporter Exporter
+	options  TracerOptions
+	queue    chan *Span
+	flush    chan chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+func NewTracer(service string, exporter Exporter, options TracerOptions) *Tracer {
+	if options.BatchSize == 0 {
+		options.BatchSize = 128
+	}
+	if options.Interval == 0 {
+		options.Interval = 5 * time.Second
+	}
+	if options.QueueSize == 0 {
+		options.QueueSize = 2048
+	}
+	t := &Tracer{
+		service:  service,
+		exporter: exporter,
+		options:  options,
+		queue:    make(chan *Span, options.QueueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start creates a span child of the span, or remote span context, found in ctx
+// and returns a context carrying it.
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	span := &Span{Name: name, Kind: kind, Service: t.service, StartTime: time.Now(), tracer: t}
+	if parent, ok := SpanContextFromContext(ctx); ok {
+		span.context = parent
+		span.ParentID = parent.SpanID
+	} else {
+		span.context.TraceID = newTraceID()
+		if t.options.SampleRoot == nil || t.options.SampleRoot() {
+			span.context.Flags = flagSampled
+		}
+	}
+	span.context.SpanID = newSpanID()
+	span.TraceID = span.context.TraceID
+	span.SpanID = span.context.SpanID
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case <-t.done:
+	case t.queue <- span:
+	default:
+	}
+}
+
+func (t *Tracer) export(batch []*Span) []*Span {
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := t.exporter.Export(ctx, batch); err != nil {
+		slog.Default().Error("exporting spans", "error", err, "spans", len(batch))
+	}
+	return batch[:0]
+}
+
+func (t *Tracer) drain(batch []*Span) []*Span {
+	for {
+		select {
+		case span := <-t.queue:
+			if batch = append(batch, span); len(batch) >= t.options.BatchSize {
+				batch = t.export(batch)
+			}
+		default:
+			return t.export(batch)
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.options.Interval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, t.options.BatchSize)
+	for {
+		select {
+		case span := <-t.queue:
+			if batch = append(batch, span); len(batch) >= t.options.BatchSize {
+				batch = t.export(batch)
+			}
+		case <-ticker.C:
+			batch = t.export(batch)
+		case ack := <-t.flush:
+			batch = t.drain(batch)
+			close(ack)
+		case <-t.done:
+			t.drain(batch)
+			return
+		}
+	}
+}
+
+// Flush exports the queued spans and waits until done or ctx expires.
+func (t *Tracer) Flush(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case t.flush <- ack:
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown exports the queued spans and stops the tracer, it can be used as
+// a server shutdown hook.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.once.Do(func() { close(t.done) })
+	select {
+	case <-t.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
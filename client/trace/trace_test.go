@@ -0,0 +1,87 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	type testCase struct {
+		value string
+		valid bool
+	}
+	cases := []testCase{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"garbage", false},
+	}
+	for _, c := range cases {
+		sc, err := ParseTraceparent(c.value)
+		if (err == nil) != c.valid {
+			t.Fatalf("%s: expected valid=%t, got error %v", c.value, c.valid, err)
+		}
+		if c.valid && sc.Traceparent()[3:] != c.value[3:55] {
+			t.Fatalf("%s: round trip gave %s", c.value, sc.Traceparent())
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var payload otlpRequest
+		if req.URL.Path != "/v1/traces" || req.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- payload
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer("orders", OTLPExporter(collector.URL+"/v1/traces", nil), TracerOptions{})
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, parent := tracer.Start(ContextWithRemote(context.Background(), remote), "parent", KindServer)
+	_, child := tracer.Start(ctx, "child", KindInternal)
+	child.SetAttribute("items", 3)
+	child.SetStatus(StatusError, "boom")
+	child.End()
+	parent.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := <-received
+	if len(payload.ResourceSpans) != 1 {
+		t.Fatalf("expected one resource, got %d", len(payload.ResourceSpans))
+	}
+	rs := payload.ResourceSpans[0]
+	if *rs.Resource.Attributes[0].Value.StringValue != "orders" {
+		t.Fatal("expected service.name to be exported")
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || p.TraceID != c.TraceID {
+		t.Fatalf("expected remote trace id, got %s and %s", c.TraceID, p.TraceID)
+	}
+	if p.ParentSpanID != "00f067aa0ba902b7" || c.ParentSpanID != p.SpanID {
+		t.Fatalf("unexpected parents %s and %s", p.ParentSpanID, c.ParentSpanID)
+	}
+	if c.Status.Code != StatusError || c.Attributes[0].Key != "items" || *c.Attributes[0].Value.IntValue != "3" {
+		t.Fatalf("unexpected child span %+v", c)
+	}
+}
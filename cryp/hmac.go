@@ -0,0 +1,47 @@
+package cryp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+type Signer interface {
+	Sign(plain []byte) string
+	Verify(signed string) ([]byte, error)
+}
+
+type hmacSigner struct {
+	key []byte
+}
+
+func HMAC(key []byte) Signer {
+	return &hmacSigner{key}
+}
+
+func (h *hmacSigner) mac(plain []byte) []byte {
+	m := hmac.New(sha256.New, h.key)
+	m.Write(plain)
+	return m.Sum(nil)
+}
+
+func (h *hmacSigner) Sign(plain []byte) string {
+	signed := make([]byte, 0, len(plain)+sha256.Size)
+	signed = append(signed, plain...)
+	return encodeString(append(signed, h.mac(plain)...))
+}
+
+func (h *hmacSigner) Verify(signed string) ([]byte, error) {
+	data, err := decodeString(signed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sha256.Size {
+		return nil, fmt.Errorf("signed data too short")
+	}
+	plain, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if !hmac.Equal(sum, h.mac(plain)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return plain, nil
+}
@@ -0,0 +1,35 @@
+package cryp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHMAC(t *testing.T) {
+	signer := HMAC([]byte("key"))
+	signed := signer.Sign([]byte(plain))
+	data, err := signer.Verify(signed)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if !bytes.Equal(data, []byte(plain)) {
+		t.Errorf("got %s, want %s", data, plain)
+	}
+	raw, _ := decodeString(signed)
+	for i := range raw {
+		tampered := bytes.Clone(raw)
+		tampered[i] ^= 1
+		if _, err := signer.Verify(encodeString(tampered)); err == nil {
+			t.Fatalf("accepted data tampered at byte %d", i)
+		}
+	}
+	if _, err := HMAC([]byte("other")).Verify(signed); err == nil {
+		t.Error("accepted data signed with another key")
+	}
+	if _, err := signer.Verify(encodeString([]byte("short"))); err == nil {
+		t.Error("accepted data shorter than the mac")
+	}
+	if _, err := signer.Verify("not base64!"); err == nil {
+		t.Error("accepted invalid encoding")
+	}
+}
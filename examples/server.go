@@ -1,6 +1,7 @@
 package examples
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -39,8 +40,8 @@ func Server(port int) {
 		Build(); err != nil {
 		log.Fatal(err)
 	}
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), router); err != nil {
-		panic(err)
+	if err := server.Run(context.Background(), server.ServerConfig{Addr: fmt.Sprintf(":%d", port)}, router); err != nil {
+		log.Fatal(err)
 	}
 }
 
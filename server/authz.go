@@ -0,0 +1,253 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Principal is an authenticated user. Roles and Scopes are issued as the roles
+// and scope claims of its tokens, Claims are added as is.
+type Principal struct {
+	Subject string
+	Roles   []string
+	Scopes  []string
+	Claims  map[string]any
+}
+
+func (p *Principal) claims() jwt.MapClaims {
+	claims := jwt.MapClaims{}
+	for k, v := range p.Claims {
+		claims[k] = v
+	}
+	claims["sub"] = p.Subject
+	if len(p.Roles) > 0 {
+		claims["roles"] = p.Roles
+	}
+	if len(p.Scopes) > 0 {
+		claims["scope"] = strings.Join(p.Scopes, " ")
+	}
+	return claims
+}
+
+func mapClaims(req *http.Request) jwt.MapClaims {
+	claims, _ := JwtClaims(req).(jwt.MapClaims)
+	return claims
+}
+
+func stringList(v any) []string {
+	switch list := v.(type) {
+	case string:
+		return strings.Fields(list)
+	case []string:
+		return list
+	case []any:
+		values := make([]string, 0, len(list))
+		for _, item := range list {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Roles returns the roles claim of the authenticated request.
+func Roles(req *http.Request) []string {
+	return stringList(mapClaims(req)["roles"])
+}
+
+// Scopes returns the scope claim of the authenticated request, or scp as
+// issued by some providers.
+func Scopes(req *http.Request) []string {
+	claims := mapClaims(req)
+	if scope, ok := claims["scope"]; ok {
+		return stringList(scope)
+	}
+	return stringList(claims["scp"])
+}
+
+// claimString formats claim values for comparisons, JSON numbers are decoded
+// as float64 and fmt would print big ones in exponent notation.
+func claimString(v any) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Condition is an attribute evaluated by a Policy against the request, its
+// claims, path params and method.
+type Condition func(req *http.Request) bool
+
+func Authenticated() Condition {
+	return func(req *http.Request) bool {
+		return JwtClaims(req) != nil
+	}
+}
+
+// HasRole holds if the request has any of roles.
+func HasRole(roles ...string) Condition {
+	return func(req *http.Request) bool {
+		granted := Roles(req)
+		for _, role := range roles {
+			if contains(granted, role) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HasScope holds if the request has all of scopes. It panics without scopes,
+// which would allow every request.
+func HasScope(scopes ...string) Condition {
+	if len(scopes) == 0 {
+		panic("HasScope requires at least one scope")
+	}
+	return func(req *http.Request) bool {
+		granted := Scopes(req)
+		for _, scope := range scopes {
+			if !contains(granted, scope) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func MethodIs(methods ...string) Condition {
+	return func(req *http.Request) bool {
+		return contains(methods, req.Method)
+	}
+}
+
+func ClaimEquals(claim string, value any) Condition {
+	return func(req *http.Request) bool {
+		v, ok := mapClaims(req)[claim]
+		return ok && claimString(v) == claimString(value)
+	}
+}
+
+// ParamMatchesClaim holds if the path param equals the claim, as in
+// ParamMatchesClaim("user", "sub") to let users reach only their resources.
+func ParamMatchesClaim(param, claim string) Condition {
+	return func(req *http.Request) bool {
+		p, ok := PathParams(req)[param]
+		v, found := mapClaims(req)[claim]
+		return ok && found && p == claimString(v)
+	}
+}
+
+func AllOf(conditions ...Condition) Condition {
+	return func(req *http.Request) bool {
+		for _, c := range conditions {
+			if !c(req) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func AnyOf(conditions ...Condition) Condition {
+	return func(req *http.Request) bool {
+		for _, c := range conditions {
+			if c(req) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func Not(condition Condition) Condition {
+	return func(req *http.Request) bool {
+		return !condition(req)
+	}
+}
+
+type policyRule struct {
+	allow bool
+	when  Condition
+}
+
+// Policy allows a request if an allow rule matches and no deny rule does,
+// denying everything else.
+type Policy struct {
+	rules []policyRule
+}
+
+func NewPolicy() *Policy {
+	return &Policy{}
+}
+
+// Allow adds a rule matching when all conditions hold.
+func (p *Policy) Allow(conditions ...Condition) *Policy {
+	p.rules = append(p.rules, policyRule{true, AllOf(conditions...)})
+	return p
+}
+
+// Deny adds a rule matching when all conditions hold, overriding any allow.
+func (p *Policy) Deny(conditions ...Condition) *Policy {
+	p.rules = append(p.rules, policyRule{false, AllOf(conditions...)})
+	return p
+}
+
+func (p *Policy) Allowed(req *http.Request) bool {
+	allowed := false
+	for _, rule := range p.rules {
+		if rule.when(req) {
+			if !rule.allow {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// forbid responds 401 to anonymous requests and 403 to authenticated ones.
+func forbid(w http.ResponseWriter, req *http.Request) {
+	if JwtClaims(req) == nil {
+		Response(w).Status(http.StatusUnauthorized).WithBody(Localize(req, "unauthorized")).AsTextPlain()
+		return
+	}
+	Response(w).Status(http.StatusForbidden).WithBody(Localize(req, "forbidden")).AsTextPlain()
+}
+
+// Authorize continues the chain if policy allows the request. It must follow
+// SoftAuthHandler or StrictAuthHandler so the claims are available.
+func Authorize(policy *Policy) ChainHandler {
+	return func(w http.ResponseWriter, req *http.Request) bool {
+		if policy.Allowed(req) {
+			return true
+		}
+		forbid(w, req)
+		return false
+	}
+}
+
+// RequireRole continues the chain if the request has any of roles.
+func RequireRole(roles ...string) ChainHandler {
+	return Authorize(NewPolicy().Allow(HasRole(roles...)))
+}
+
+// RequireScope continues the chain if the request has all of scopes, it
+// panics without scopes.
+func RequireScope(scopes ...string) ChainHandler {
+	return Authorize(NewPolicy().Allow(HasScope(scopes...)))
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthorization(t *testing.T) {
+	ja := NewJwtAuth([]byte("secret"), time.Hour, nil)
+	soft := ja.SoftAuthHandler()
+	ok := func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	users := NewPolicy().
+		Allow(HasRole("admin")).
+		Allow(ParamMatchesClaim("user", "sub")).
+		Deny(MethodIs(http.MethodDelete), Not(HasRole("admin")))
+	router, err := NewRouterBuilder().
+		Get("/admin", Handle(soft, RequireRole("admin", "root"), ok)).
+		Post("/orders", Handle(soft, RequireScope("orders:read", "orders:write"), ok)).
+		Get("/users/:user", Handle(soft, Authorize(users), ok)).
+		Delete("/users/:user", Handle(soft, Authorize(users), ok)).
+		Get("/accounts/:account", Handle(soft, Authorize(NewPolicy().Allow(ParamMatchesClaim("account", "account_id"), ClaimEquals("tier", 2))), ok)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &Principal{Subject: "alice", Scopes: []string{"orders:read", "orders:write"}}
+	bob := &Principal{Subject: "bob", Roles: []string{"admin"}, Scopes: []string{"orders:read"}}
+	carol := &Principal{Subject: "carol", Claims: map[string]any{"account_id": 123456789, "tier": 2}}
+	type testCase struct {
+		method    string
+		path      string
+		principal *Principal
+		status    int
+	}
+	cases := []testCase{
+		{http.MethodGet, "/admin", nil, http.StatusUnauthorized},
+		{http.MethodGet, "/admin", alice, http.StatusForbidden},
+		{http.MethodGet, "/admin", bob, http.StatusOK},
+		{http.MethodPost, "/orders", alice, http.StatusOK},
+		{http.MethodPost, "/orders", bob, http.StatusForbidden},
+		{http.MethodGet, "/users/alice", alice, http.StatusOK},
+		{http.MethodGet, "/users/bob", alice, http.StatusForbidden},
+		{http.MethodGet, "/users/alice", bob, http.StatusOK},
+		{http.MethodDelete, "/users/alice", alice, http.StatusForbidden},
+		{http.MethodDelete, "/users/alice", bob, http.StatusOK},
+		{http.MethodGet, "/accounts/123456789", carol, http.StatusOK},
+		{http.MethodGet, "/accounts/123456780", carol, http.StatusForbidden},
+		{http.MethodGet, "/accounts/123456789", alice, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.principal != nil {
+			cookie, err := ja.PrincipalCookie(c.principal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s %s as %v: expected %d, got %d", c.method, c.path, c.principal, c.status, rec.Code)
+		}
+	}
+}
+
+func TestRequireScopeWithoutScopes(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected an empty scope list to be rejected")
+		}
+	}()
+	RequireScope()
+}
@@ -0,0 +1,418 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"github.com/enolgor/go-utils-mm/client/trace"
+)
+
+type CacheOptions struct {
+	MaxEntries int
+	MaxBytes   int64
+	// MaxBodySize is the largest response body stored, bigger responses are
+	// served but not cached.
+	MaxBodySize int64
+	// DefaultTTL applies to responses without max-age, s-maxage or Expires,
+	// zero disables caching them.
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+}
+
+type cacheEntry struct {
+	key     string
+	base    string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+	route   string
+	tags    []string
+	element *list.Element
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.body) + len(e.key))
+}
+
+type cacheCall struct {
+	done chan struct{}
+}
+
+// cacheVariants holds the entries stored for a base key, one per combination
+// of the values of the headers the response varies on.
+type cacheVariants struct {
+	vary    []string
+	entries map[string]*cacheEntry
+}
+
+type ResponseCache struct {
+	options  CacheOptions
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*cacheEntry
+	bases    map[string]*cacheVariants
+	bytes    int64
+	inflight map[string]*cacheCall
+	now      func() time.Time
+}
+
+func NewResponseCache(options CacheOptions) *ResponseCache {
+	if options.MaxEntries == 0 {
+		options.MaxEntries = 1000
+	}
+	if options.MaxBytes == 0 {
+		options.MaxBytes = 64 << 20
+	}
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = 1 << 20
+	}
+	if options.MaxTTL == 0 {
+		options.MaxTTL = time.Hour
+	}
+	return &ResponseCache{
+		options:  options,
+		lru:      list.New(),
+		entries:  map[string]*cacheEntry{},
+		bases:    map[string]*cacheVariants{},
+		inflight: map[string]*cacheCall{},
+		now:      time.Now,
+	}
+}
+
+type cacheContextKey int
+
+const cacheTagsKey cacheContextKey = iota
+
+// CacheTags attaches tags to the response being cached so it can later be
+// dropped with InvalidateTag.
+func CacheTags(req *http.Request, tags ...string) {
+	var current *[]string
+	if GetContextValue(req, cacheTagsKey, &current) {
+		*current = append(*current, tags...)
+	}
+}
+
+func parseCacheControl(header string) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	return directives
+}
+
+func baseCacheKey(req *http.Request) string {
+	return req.Host + req.URL.RequestURI()
+}
+
+func varyKey(base string, vary []string, req *http.Request) string {
+	key := base
+	for _, header := range vary {
+		key += "\x00" + header + "=" + strings.Join(req.Header.Values(header), ",")
+	}
+	return key
+}
+
+func (c *ResponseCache) lookup(req *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	base := baseCacheKey(req)
+	variants, ok := c.bases[base]
+	if !ok {
+		return nil
+	}
+	entry, ok := variants.entries[varyKey(base, variants.vary, req)]
+	if !ok {
+		return nil
+	}
+	if c.now().After(entry.expires) {
+		c.remove(entry)
+		return nil
+	}
+	c.lru.MoveToFront(entry.element)
+	return entry
+}
+
+func (c *ResponseCache) remove(entry *cacheEntry) {
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+	if variants, ok := c.bases[entry.base]; ok {
+		delete(variants.entries, entry.key)
+		if len(variants.entries) == 0 {
+			delete(c.bases, entry.base)
+		}
+	}
+}
+
+func (c *ResponseCache) store(entry *cacheEntry, vary []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.bases[entry.base]; ok && strings.Join(old.vary, ",") != strings.Join(vary, ",") {
+		for _, e := range old.entries {
+			c.remove(e)
+		}
+	}
+	if old, ok := c.entries[entry.key]; ok {
+		c.remove(old)
+	}
+	variants, ok := c.bases[entry.base]
+	if !ok {
+		variants = &cacheVariants{vary: vary, entries: map[string]*cacheEntry{}}
+		c.bases[entry.base] = variants
+	}
+	entry.element = c.lru.PushFront(entry)
+	c.entries[entry.key] = entry
+	variants.entries[entry.key] = entry
+	c.bytes += entry.size()
+	for c.lru.Len() > c.options.MaxEntries || c.bytes > c.options.MaxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+func (c *ResponseCache) invalidate(match func(*cacheEntry) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for _, entry := range c.entries {
+		if match(entry) {
+			c.remove(entry)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *ResponseCache) InvalidateRoute(expr string) int {
+	return c.invalidate(func(e *cacheEntry) bool { return e.route == expr })
+}
+
+func (c *ResponseCache) InvalidateTag(tag string) int {
+	return c.invalidate(func(e *cacheEntry) bool {
+		for _, t := range e.tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (c *ResponseCache) Purge() {
+	c.invalidate(func(*cacheEntry) bool { return true })
+}
+
+func (c *ResponseCache) serve(w http.ResponseWriter, req *http.Request, entry *cacheEntry) {
+	header := w.Header()
+	for k, v := range entry.header {
+		header[k] = append([]string{}, v...)
+	}
+	header.Set("Age", strconv.Itoa(int(c.now().Sub(entry.stored).Seconds())))
+	w.WriteHeader(entry.status)
+	if req.Method != http.MethodHead {
+		w.Write(entry.body)
+	}
+}
+
+// privateRequest reports if the response may depend on who is asking, those
+// are only stored when the response is explicitly marked as shareable.
+func privateRequest(req *http.Request) bool {
+	if req.Header.Get(client.Authorization) != "" || req.Header.Get(client.Cookie) != "" || JwtClaims(req) != nil {
+		return true
+	}
+	session := Session(req)
+	return session != nil && (!session.IsNew() || session.Modified())
+}
+
+var cacheableStatus = map[int]bool{200: true, 203: true, 204: true, 301: true, 404: true, 410: true}
+
+// ttl returns how long a response can be stored by a shared cache, zero
+// when it can't be stored at all.
+func (c *ResponseCache) ttl(req *http.Request, status int, header http.Header) time.Duration {
+	if !cacheableStatus[status] || header.Get(client.SetCookie) != "" {
+		return 0
+	}
+	cc := parseCacheControl(header.Get(client.CacheControl))
+	if _, ok := cc["no-store"]; ok {
+		return 0
+	}
+	if _, ok := cc["private"]; ok {
+		return 0
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if strings.Contains(header.Get(client.Vary), "*") {
+		return 0
+	}
+	_, public := cc["public"]
+	_, sMaxAge := cc["s-maxage"]
+	if privateRequest(req) && !public && !sMaxAge {
+		return 0
+	}
+	ttl := c.options.DefaultTTL
+	if v, ok := cc["s-maxage"]; ok {
+		if secs, err := strconv.Atoi(v); err == nil {
+			ttl = time.Duration(secs) * time.Second
+		}
+	} else if v, ok := cc["max-age"]; ok {
+		if secs, err := strconv.Atoi(v); err == nil {
+			ttl = time.Duration(secs) * time.Second
+		}
+	} else if expires, err := http.ParseTime(header.Get(client.Expires)); err == nil {
+		ttl = expires.Sub(c.now())
+	}
+	if ttl > c.options.MaxTTL {
+		ttl = c.options.MaxTTL
+	}
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// perRequestHeaders are set for every request by middlewares like AccessLog,
+// Tracing or SecurityHeaders, a stored response must not replay them.
+var perRequestHeaders = []string{
+	client.XRequestID,
+	trace.TraceparentHeader,
+	trace.TracestateHeader,
+	client.ContentSecurityPolicy,
+	client.ContentSecurityPolicyReportOnly,
+}
+
+func storedHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range perRequestHeaders {
+		header.Del(name)
+	}
+	return header
+}
+
+type cacheWriter struct {
+	*responseWriter
+	header    http.Header
+	body      bytes.Buffer
+	max       int64
+	oversized bool
+}
+
+// snapshot keeps the headers as sent, it runs after the status so headers
+// added by the before header hooks, like a session cookie, are seen.
+func (cw *cacheWriter) snapshot() {
+	if cw.header == nil {
+		cw.header = cw.Header().Clone()
+	}
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	cw.responseWriter.WriteHeader(status)
+	cw.snapshot()
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	n, err := cw.responseWriter.Write(b)
+	cw.snapshot()
+	if !cw.oversized {
+		if int64(cw.body.Len()+len(b)) > cw.max {
+			cw.oversized = true
+			cw.body.Reset()
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	return n, err
+}
+
+func (c *ResponseCache) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !isGetOrHead(req) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			reqCC := parseCacheControl(req.Header.Get(client.CacheControl))
+			if _, ok := reqCC["no-store"]; ok {
+				next.ServeHTTP(w, req)
+				return
+			}
+			_, noCache := reqCC["no-cache"]
+			if !noCache {
+				if entry := c.lookup(req); entry != nil {
+					c.serve(w, req, entry)
+					return
+				}
+			}
+
+			base := baseCacheKey(req)
+			c.mu.Lock()
+			if call, ok := c.inflight[base]; ok && !noCache {
+				c.mu.Unlock()
+				<-call.done
+				if entry := c.lookup(req); entry != nil {
+					c.serve(w, req, entry)
+					return
+				}
+				next.ServeHTTP(w, req)
+				return
+			}
+			call := &cacheCall{done: make(chan struct{})}
+			c.inflight[base] = call
+			c.mu.Unlock()
+			defer func() {
+				c.mu.Lock()
+				if c.inflight[base] == call {
+					delete(c.inflight, base)
+				}
+				c.mu.Unlock()
+				close(call.done)
+			}()
+
+			tags := &[]string{}
+			AddContextValue(req, cacheTagsKey, tags)
+			cw := &cacheWriter{responseWriter: wrapResponseWriter(w), max: c.options.MaxBodySize}
+			next.ServeHTTP(cw, req)
+			if cw.oversized || cw.header == nil || req.Method == http.MethodHead {
+				return
+			}
+			ttl := c.ttl(req, cw.Status(), cw.header)
+			if ttl == 0 {
+				return
+			}
+			vary := []string{}
+			for _, v := range cw.header.Values(client.Vary) {
+				for _, h := range strings.Split(v, ",") {
+					if h = client.NormalizeHeader(strings.TrimSpace(h)); h != "" {
+						vary = append(vary, h)
+					}
+				}
+			}
+			sort.Strings(vary)
+			now := c.now()
+			c.store(&cacheEntry{
+				key:     varyKey(base, vary, req),
+				base:    base,
+				status:  cw.Status(),
+				header:  storedHeader(cw.header),
+				body:    append([]byte{}, cw.body.Bytes()...),
+				stored:  now,
+				expires: now.Add(ttl),
+				route:   RouteExpr(req),
+				tags:    *tags,
+			}, vary)
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"github.com/enolgor/go-utils-mm/client/trace"
+	"github.com/enolgor/go-utils-mm/server/sessions"
+)
+
+func TestResponseCache(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	cache := NewResponseCache(CacheOptions{MaxEntries: 3})
+	cache.now = clock.now
+	var calls atomic.Int32
+	router, err := NewRouterBuilder().
+		Use(cache.Middleware()).
+		Get("/items/:id", func(w http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+			CacheTags(req, "item:"+PathParams(req)["id"])
+			w.Header().Set(client.CacheControl, "max-age=60")
+			w.Header().Set(client.Vary, client.AcceptLanguage)
+			Response(w).WithBody(fmt.Sprintf("%s %s", PathParams(req)["id"], req.Header.Get(client.AcceptLanguage))).AsTextPlain()
+		}).
+		Get("/private", func(w http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+			w.Header().Set(client.CacheControl, "private, max-age=60")
+			w.WriteHeader(http.StatusOK)
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(path string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	expectCalls := func(expected int32, msg string) {
+		t.Helper()
+		if calls.Load() != expected {
+			t.Errorf("%s: expected %d handler calls, got %d", msg, expected, calls.Load())
+		}
+		calls.Store(0)
+	}
+
+	send("/items/1")
+	clock.t = clock.t.Add(10 * time.Second)
+	rec := send("/items/1")
+	if rec.Body.String() != "1 " || rec.Header().Get("Age") != "10" {
+		t.Errorf("expected cached response with its age, got %q %v", rec.Body, rec.Header())
+	}
+	expectCalls(1, "repeated request")
+
+	send("/items/1", client.AcceptLanguage, "es")
+	if rec := send("/items/1", client.AcceptLanguage, "es"); rec.Body.String() != "1 es" {
+		t.Errorf("expected the variant of the request, got %q", rec.Body)
+	}
+	expectCalls(1, "vary")
+
+	send("/items/1", client.CacheControl, "no-cache")
+	send("/private")
+	send("/private")
+	expectCalls(3, "no-cache and private")
+
+	clock.t = clock.t.Add(time.Minute + time.Second)
+	send("/items/1")
+	expectCalls(1, "expired")
+
+	send("/items/2")
+	send("/items/3")
+	send("/items/1")
+	expectCalls(2, "filling the cache")
+	send("/items/2")
+	send("/items/1", client.AcceptLanguage, "es")
+	expectCalls(1, "evicting the least recently used")
+
+	if n := cache.InvalidateTag("item:1"); n != 2 {
+		t.Errorf("expected both variants invalidated by tag, got %d", n)
+	}
+	if n := cache.InvalidateRoute("/items/:id"); n != 1 {
+		t.Errorf("expected the remaining entry invalidated by route, got %d", n)
+	}
+	send("/items/1")
+	expectCalls(1, "invalidated")
+	cache.Purge()
+	if len(cache.entries) != 0 || len(cache.bases) != 0 || cache.lru.Len() != 0 || cache.bytes != 0 {
+		t.Errorf("expected an empty cache after purge, got %d entries %d bytes", len(cache.entries), cache.bytes)
+	}
+}
+
+func TestResponseCachePrivateRequests(t *testing.T) {
+	cache := NewResponseCache(CacheOptions{})
+	ja := NewJwtAuth([]byte("secret"), time.Hour, nil)
+	var calls atomic.Int32
+	// tracking sets a cookie right before the status is sent, after the
+	// handler returned its cacheable headers.
+	tracking := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rw := wrapResponseWriter(w)
+			if req.URL.Path == "/tracked" {
+				rw.onBeforeHeader(func() { http.SetCookie(rw, &http.Cookie{Name: "seen", Value: "1"}) })
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+	router, err := NewRouterBuilder().
+		Use(Sessions(sessions.NewMemoryStore(time.Minute), SessionOptions{}), tracking, cache.Middleware()).
+		Get("/profile", Handle(ja.SoftAuthHandler(), func(w http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+			w.Header().Set(client.CacheControl, "max-age=60")
+			subject := "anonymous"
+			if claims := JwtClaims(req); claims != nil {
+				subject, _ = claims.GetSubject()
+			}
+			Response(w).WithBody(subject).AsTextPlain()
+		})).
+		Get("/visit", func(w http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+			Session(req).Set("visited", true)
+			w.Header().Set(client.CacheControl, "max-age=60")
+			w.WriteHeader(http.StatusOK)
+		}).
+		Get("/tracked", func(w http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+			w.Header().Set(client.CacheControl, "public, max-age=60")
+			w.WriteHeader(http.StatusOK)
+		}).
+		Get("/public", func(w http.ResponseWriter, req *http.Request) {
+			calls.Add(1)
+			w.Header().Set(client.CacheControl, "public, max-age=60")
+			w.WriteHeader(http.StatusOK)
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(path string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	alice, _ := ja.TokenCookie("alice")
+	if rec := send("/profile", alice); rec.Body.String() != "alice" {
+		t.Fatalf("expected alice's profile, got %q", rec.Body)
+	}
+	if rec := send("/profile"); rec.Body.String() != "anonymous" {
+		t.Errorf("expected a response for a cookie to never be shared, got %q", rec.Body)
+	}
+	if rec := send("/profile", &http.Cookie{Name: "theme", Value: "dark"}); rec.Body.String() != "anonymous" {
+		t.Errorf("expected the anonymous response, got %q", rec.Body)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected only the anonymous response to be cached, got %d calls", calls.Load())
+	}
+
+	calls.Store(0)
+	if rec := send("/visit"); rec.Header().Get(client.SetCookie) == "" {
+		t.Fatal("expected a session cookie")
+	}
+	if rec := send("/visit"); rec.Header().Get(client.SetCookie) == "" {
+		t.Error("expected a response setting a session cookie to not be cached")
+	}
+	if rec := send("/tracked"); rec.Header().Get(client.SetCookie) == "" {
+		t.Fatal("expected the tracking cookie")
+	}
+	if rec := send("/tracked"); rec.Header().Get(client.SetCookie) == "" {
+		t.Error("expected a cookie set by a hook to prevent caching")
+	}
+	send("/public", alice)
+	send("/public")
+	if calls.Load() != 5 {
+		t.Errorf("expected explicitly public responses to be cached, got %d calls", calls.Load())
+	}
+}
+
+func TestResponseCacheCoalescing(t *testing.T) {
+	cache := NewResponseCache(CacheOptions{})
+	release := make(chan struct{})
+	var calls atomic.Int32
+	handler := cache.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Header().Set(client.CacheControl, "max-age=60")
+		w.Write([]byte("slow"))
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+			if rec.Body.String() != "slow" {
+				t.Errorf("unexpected body %q", rec.Body)
+			}
+		}()
+	}
+	for {
+		cache.mu.Lock()
+		started := len(cache.inflight) == 1
+		cache.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Errorf("expected concurrent misses to share one call, got %d", calls.Load())
+	}
+}
+
+func TestResponseCachePerRequestHeaders(t *testing.T) {
+	cache := NewResponseCache(CacheOptions{})
+	var requests atomic.Int32
+	requestID := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set(client.XRequestID, strconv.Itoa(int(requests.Add(1))))
+			next.ServeHTTP(w, req)
+		})
+	}
+	router, err := NewRouterBuilder().
+		Use(requestID, cache.Middleware()).
+		Get("/page", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set(client.CacheControl, "max-age=60")
+			w.Header().Set(trace.TraceparentHeader, "00-"+strings.Repeat("1", 32)+"-"+strings.Repeat("2", 16)+"-01")
+			w.Header().Set(client.ContentSecurityPolicy, "script-src 'nonce-abc'")
+			Response(w).WithBody("page").AsTextPlain()
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/page", nil))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page", nil))
+	if rec.Header().Get("Age") == "" || rec.Body.String() != "page" {
+		t.Fatalf("expected a cached response, got %v %q", rec.Header(), rec.Body)
+	}
+	if id := rec.Header().Get(client.XRequestID); id != "2" {
+		t.Errorf("expected the id of the current request, got %q", id)
+	}
+	if rec.Header().Get(trace.TraceparentHeader) != "" || rec.Header().Get(client.ContentSecurityPolicy) != "" {
+		t.Errorf("expected per request headers to not be replayed, got %v", rec.Header())
+	}
+}
+
+func TestResponseCacheNoCacheLeader(t *testing.T) {
+	cache := NewResponseCache(CacheOptions{})
+	releases := map[string]chan struct{}{"": make(chan struct{}), "no-cache": make(chan struct{})}
+	handler := cache.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-releases[req.Header.Get(client.CacheControl)]
+		w.Header().Set(client.CacheControl, "max-age=60")
+		w.Write([]byte("slow"))
+	}))
+	leader := func() *cacheCall {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return cache.inflight["example.com/slow"]
+	}
+	send := func(cacheControl string) chan struct{} {
+		done := make(chan struct{})
+		req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+		if cacheControl != "" {
+			req.Header.Set(client.CacheControl, cacheControl)
+		}
+		go func() {
+			defer close(done)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		return done
+	}
+	waitLeader := func(previous *cacheCall) *cacheCall {
+		for {
+			if call := leader(); call != nil && call != previous {
+				return call
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	first := send("")
+	firstCall := waitLeader(nil)
+	reload := send("no-cache")
+	reloadCall := waitLeader(firstCall)
+	close(releases[""])
+	<-first
+	if leader() != reloadCall {
+		t.Error("expected the first leader to leave the reload in flight")
+	}
+	close(releases["no-cache"])
+	<-reload
+	if leader() != nil {
+		t.Error("expected no call in flight")
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+type Validators struct {
+	ETag         string
+	LastModified time.Time
+}
+
+func NewETag(value string, weak bool) string {
+	if weak {
+		return fmt.Sprintf(`W/"%s"`, value)
+	}
+	return fmt.Sprintf(`"%s"`, value)
+}
+
+func hashETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	return NewETag(base64.RawURLEncoding.EncodeToString(sum[:16]), weak)
+}
+
+func opaqueTag(etag string) (string, bool) {
+	etag = strings.TrimSpace(etag)
+	if strings.HasPrefix(etag, "W/") {
+		return etag[2:], true
+	}
+	return etag, false
+}
+
+// etagMatch reports if etag matches any entry of an If-Match or If-None-Match
+// header, using the strong comparison when strong is set.
+func etagMatch(header, etag string, strong bool) bool {
+	if etag == "" {
+		return false
+	}
+	tag, weak := opaqueTag(etag)
+	if strong && weak {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		ctag, cweak := opaqueTag(candidate)
+		if strong && cweak {
+			continue
+		}
+		if ctag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func isGetOrHead(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// evaluatePreconditions returns the status the request must be answered with,
+// or 0 when the request should be processed.
+func evaluatePreconditions(req *http.Request, v Validators) int {
+	if ifMatch := req.Header.Get(client.IfMatch); ifMatch != "" {
+		if !etagMatch(ifMatch, v.ETag, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(req.Header.Get(client.IfUnmodifiedSince)); err == nil && !v.LastModified.IsZero() {
+		if v.LastModified.Truncate(time.Second).After(since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if ifNoneMatch := req.Header.Get(client.IfNoneMatch); ifNoneMatch != "" {
+		if etagMatch(ifNoneMatch, v.ETag, false) {
+			if isGetOrHead(req) {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if since, err := http.ParseTime(req.Header.Get(client.IfModifiedSince)); err == nil && isGetOrHead(req) && !v.LastModified.IsZero() {
+		if !v.LastModified.Truncate(time.Second).After(since) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+func setValidators(header http.Header, v Validators) {
+	if v.ETag != "" {
+		header.Set(client.ETag, v.ETag)
+	}
+	if !v.LastModified.IsZero() {
+		header.Set(client.LastModified, v.LastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+func writeNotModified(w http.ResponseWriter) {
+	header := w.Header()
+	header.Del(client.ContentType)
+	header.Del(client.ContentLength)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// CheckPreconditions sets the validators on the response and evaluates the
+// conditional headers of the request against them. When it returns false the
+// response (304 or 412) has been written and the handler must stop, so the
+// body never has to be computed.
+func CheckPreconditions(w http.ResponseWriter, req *http.Request, v Validators) bool {
+	setValidators(w.Header(), v)
+	switch evaluatePreconditions(req, v) {
+	case http.StatusNotModified:
+		writeNotModified(w)
+		return false
+	case http.StatusPreconditionFailed:
+		Response(w).Status(http.StatusPreconditionFailed).WithBody(Localize(req, "precondition failed")).AsTextPlain()
+		return false
+	}
+	return true
+}
+
+func Preconditions(validators func(req *http.Request) Validators) ChainHandler {
+	return func(w http.ResponseWriter, req *http.Request) bool {
+		return CheckPreconditions(w, req, validators(req))
+	}
+}
+
+type ETagOptions struct {
+	Weak bool
+	// MaxSize is the largest body buffered to compute an ETag, bigger
+	// responses are streamed without validators.
+	MaxSize int
+}
+
+type etagWriter struct {
+	http.ResponseWriter
+	buf         bytes.Buffer
+	status      int
+	max         int
+	passthrough bool
+}
+
+func (ew *etagWriter) WriteHeader(status int) {
+	if ew.passthrough || ew.status != 0 {
+		if ew.passthrough {
+			ew.ResponseWriter.WriteHeader(status)
+		}
+		return
+	}
+	ew.status = status
+	if status != http.StatusOK {
+		ew.flush()
+	}
+}
+
+func (ew *etagWriter) Write(b []byte) (int, error) {
+	if ew.passthrough {
+		return ew.ResponseWriter.Write(b)
+	}
+	if ew.status == 0 {
+		ew.status = http.StatusOK
+	}
+	if ew.buf.Len()+len(b) > ew.max {
+		ew.flush()
+		return ew.ResponseWriter.Write(b)
+	}
+	return ew.buf.Write(b)
+}
+
+func (ew *etagWriter) flush() {
+	if ew.passthrough {
+		return
+	}
+	ew.passthrough = true
+	if ew.status == 0 {
+		ew.status = http.StatusOK
+	}
+	ew.ResponseWriter.WriteHeader(ew.status)
+	if ew.buf.Len() > 0 {
+		ew.ResponseWriter.Write(ew.buf.Bytes())
+		ew.buf.Reset()
+	}
+}
+
+func (ew *etagWriter) Flush() {
+	ew.flush()
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (ew *etagWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	ew.passthrough = true
+	if h, ok := ew.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("%T does not support hijacking", ew.ResponseWriter)
+}
+
+func (ew *etagWriter) sent() bool {
+	return ew.passthrough
+}
+
+func (ew *etagWriter) discard() {
+	ew.buf.Reset()
+	ew.status = 0
+}
+
+func (ew *etagWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// ETag buffers successful GET and HEAD responses up to a size limit, tags them
+// with a hash of the body unless the handler set its own ETag, and answers
+// conditional requests with 304 or 412.
+func ETag(options ETagOptions) Middleware {
+	if options.MaxSize == 0 {
+		options.MaxSize = 1 << 20
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !isGetOrHead(req) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			ew := &etagWriter{ResponseWriter: w, max: options.MaxSize}
+			next.ServeHTTP(ew, req)
+			if ew.passthrough {
+				return
+			}
+			if ew.status == 0 {
+				ew.status = http.StatusOK
+			}
+			header := w.Header()
+			etag := header.Get(client.ETag)
+			if etag == "" {
+				etag = hashETag(ew.buf.Bytes(), options.Weak)
+				header.Set(client.ETag, etag)
+			}
+			v := Validators{ETag: etag}
+			if lm, err := http.ParseTime(header.Get(client.LastModified)); err == nil {
+				v.LastModified = lm
+			}
+			switch evaluatePreconditions(req, v) {
+			case http.StatusNotModified:
+				writeNotModified(w)
+				return
+			case http.StatusPreconditionFailed:
+				header.Del(client.ETag)
+				Response(w).Status(http.StatusPreconditionFailed).WithBody(Localize(req, "precondition failed")).AsTextPlain()
+				return
+			}
+			ew.flush()
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+func TestETagMatch(t *testing.T) {
+	type testCase struct {
+		header string
+		etag   string
+		strong bool
+		match  bool
+	}
+	testCases := []testCase{
+		{`"a"`, `"a"`, true, true},
+		{`"a"`, `"a"`, false, true},
+		{`W/"a"`, `"a"`, true, false},
+		{`W/"a"`, `"a"`, false, true},
+		{`"a"`, `W/"a"`, true, false},
+		{`"a"`, `W/"a"`, false, true},
+		{`"b", W/"a"`, `W/"a"`, false, true},
+		{`"b", "c"`, `"a"`, false, false},
+		{`*`, `"a"`, true, true},
+		{`*`, `W/"a"`, false, true},
+		{`*`, ``, false, false},
+	}
+	for _, tc := range testCases {
+		if match := etagMatch(tc.header, tc.etag, tc.strong); match != tc.match {
+			t.Errorf("etagMatch(%s, %s, strong=%v): expected %v, got %v", tc.header, tc.etag, tc.strong, tc.match, match)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	v := Validators{ETag: `"v1"`, LastModified: modified}
+	type testCase struct {
+		method string
+		header string
+		value  string
+		status int
+	}
+	testCases := []testCase{
+		{http.MethodGet, client.IfNoneMatch, `W/"v1"`, http.StatusNotModified},
+		{http.MethodGet, client.IfNoneMatch, `*`, http.StatusNotModified},
+		{http.MethodGet, client.IfNoneMatch, `"v0"`, http.StatusOK},
+		{http.MethodGet, client.IfModifiedSince, modified.Format(http.TimeFormat), http.StatusNotModified},
+		{http.MethodGet, client.IfModifiedSince, modified.Add(-time.Second).Format(http.TimeFormat), http.StatusOK},
+		{http.MethodPost, client.IfNoneMatch, `*`, http.StatusPreconditionFailed},
+		{http.MethodPut, client.IfNoneMatch, `"v1"`, http.StatusPreconditionFailed},
+		{http.MethodPut, client.IfMatch, `"v1"`, http.StatusOK},
+		{http.MethodPut, client.IfMatch, `W/"v1"`, http.StatusPreconditionFailed},
+		{http.MethodPut, client.IfMatch, `"v0"`, http.StatusPreconditionFailed},
+		{http.MethodPut, client.IfMatch, `*`, http.StatusOK},
+		{http.MethodDelete, client.IfUnmodifiedSince, modified.Add(-time.Second).Format(http.TimeFormat), http.StatusPreconditionFailed},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, "/", nil)
+		req.Header.Set(tc.header, tc.value)
+		rec := httptest.NewRecorder()
+		if CheckPreconditions(rec, req, v) {
+			rec.WriteHeader(http.StatusOK)
+		}
+		if rec.Code != tc.status {
+			t.Errorf("%s with %s %s: expected %d, got %d", tc.method, tc.header, tc.value, tc.status, rec.Code)
+		}
+		if rec.Header().Get(client.ETag) != `"v1"` {
+			t.Errorf("%s with %s %s: expected the validators to be set", tc.method, tc.header, tc.value)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	router, err := NewRouterBuilder().
+		Use(ETag(ETagOptions{MaxSize: 16})).
+		Get("/small", func(w http.ResponseWriter, req *http.Request) {
+			Response(w).WithBody("small body").AsTextPlain()
+		}).
+		Get("/large", func(w http.ResponseWriter, req *http.Request) {
+			Response(w).WithBody(strings.Repeat("x", 32)).AsTextPlain()
+		}).
+		Get("/panic", func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("partial"))
+			panic("boom")
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set(client.IfNoneMatch, ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send("/small", "")
+	etag := rec.Header().Get(client.ETag)
+	if rec.Code != http.StatusOK || etag == "" || rec.Body.String() != "small body" {
+		t.Fatalf("expected a tagged response, got %d %q %q", rec.Code, etag, rec.Body)
+	}
+	rec = send("/small", etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get(client.ContentType) != "" {
+		t.Errorf("expected 304 without body, got %d %q %v", rec.Code, rec.Body, rec.Header())
+	}
+
+	rec = send("/large", "")
+	if rec.Code != http.StatusOK || rec.Header().Get(client.ETag) != "" || rec.Body.Len() != 32 {
+		t.Errorf("expected a response over MaxSize to pass through untagged, got %d %v", rec.Code, rec.Header())
+	}
+
+	rec = send("/panic", "")
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "partial") {
+		t.Errorf("expected buffered output to be replaced by the error response, got %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+type CorsOptions struct {
+	// AllowedOrigins accepts exact origins, "*" for any origin and
+	// wildcard subdomains such as "https://*.example.com".
+	AllowedOrigins   []string
+	AllowOriginFunc  func(origin string) bool
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+type Cors struct {
+	allowAll       bool
+	origins        map[string]bool
+	wildcards      [][2]string
+	originFunc     func(string) bool
+	methods        map[string]bool
+	allowedMethods string
+	allowAnyHeader bool
+	headers        map[string]bool
+	allowedHeaders string
+	exposedHeaders string
+	credentials    bool
+	maxAge         string
+}
+
+var defaultCorsMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+var defaultCorsHeaders = []string{client.Accept, client.ContentType, client.XRequestedWith}
+
+func NewCors(options CorsOptions) *Cors {
+	c := &Cors{
+		origins:     map[string]bool{},
+		wildcards:   [][2]string{},
+		originFunc:  options.AllowOriginFunc,
+		methods:     map[string]bool{},
+		headers:     map[string]bool{},
+		credentials: options.AllowCredentials,
+	}
+	for _, origin := range options.AllowedOrigins {
+		origin = strings.ToLower(origin)
+		if origin == "*" {
+			c.allowAll = true
+		} else if idx := strings.Index(origin, "*"); idx != -1 {
+			c.wildcards = append(c.wildcards, [2]string{origin[:idx], origin[idx+1:]})
+		} else {
+			c.origins[origin] = true
+		}
+	}
+	methods := append([]string{}, options.AllowedMethods...)
+	if len(methods) == 0 {
+		methods = append(methods, defaultCorsMethods...)
+	}
+	for i := range methods {
+		methods[i] = strings.ToUpper(methods[i])
+		c.methods[methods[i]] = true
+	}
+	c.allowedMethods = strings.Join(methods, ", ")
+	headers := append([]string{}, options.AllowedHeaders...)
+	if len(headers) == 0 {
+		headers = append(headers, defaultCorsHeaders...)
+	}
+	for i := range headers {
+		if headers[i] == "*" {
+			c.allowAnyHeader = true
+			continue
+		}
+		headers[i] = client.NormalizeHeader(headers[i])
+		c.headers[headers[i]] = true
+	}
+	c.allowedHeaders = strings.Join(headers, ", ")
+	exposed := make([]string, len(options.ExposedHeaders))
+	for i := range options.ExposedHeaders {
+		exposed[i] = client.NormalizeHeader(options.ExposedHeaders[i])
+	}
+	c.exposedHeaders = strings.Join(exposed, ", ")
+	if options.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(int(options.MaxAge.Seconds()))
+	}
+	return c
+}
+
+func (c *Cors) originAllowed(origin string) bool {
+	if c.allowAll {
+		return true
+	}
+	lower := strings.ToLower(origin)
+	if c.origins[lower] {
+		return true
+	}
+	for _, w := range c.wildcards {
+		if len(lower) > len(w[0])+len(w[1]) && strings.HasPrefix(lower, w[0]) && strings.HasSuffix(lower, w[1]) {
+			return true
+		}
+	}
+	return c.originFunc != nil && c.originFunc(origin)
+}
+
+func (c *Cors) headersAllowed(requested string) bool {
+	if c.allowAnyHeader || requested == "" {
+		return true
+	}
+	for _, header := range strings.Split(requested, ",") {
+		header = client.NormalizeHeader(strings.TrimSpace(header))
+		if header != "" && !c.headers[header] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Cors) setAllowOrigin(w http.ResponseWriter, origin string) {
+	if c.allowAll && !c.credentials {
+		w.Header().Set(client.AccessControlAllowOrigin, "*")
+		return
+	}
+	w.Header().Set(client.AccessControlAllowOrigin, origin)
+	if c.credentials {
+		w.Header().Set(client.AccessControlAllowCredentials, "true")
+	}
+}
+
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get(client.AccessControlRequestMethod) != ""
+}
+
+func (c *Cors) preflight(w http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get(client.Origin)
+	w.Header().Add(client.Vary, client.Origin)
+	w.Header().Add(client.Vary, client.AccessControlRequestMethod)
+	w.Header().Add(client.Vary, client.AccessControlRequestHeaders)
+	method := strings.ToUpper(req.Header.Get(client.AccessControlRequestMethod))
+	requestedHeaders := req.Header.Get(client.AccessControlRequestHeaders)
+	if !c.originAllowed(origin) || !c.methods[method] || !c.headersAllowed(requestedHeaders) {
+		Response(w).Status(http.StatusForbidden).WithBody(fmt.Sprintf("cors preflight rejected for origin %s", origin)).AsTextPlain()
+		return
+	}
+	c.setAllowOrigin(w, origin)
+	w.Header().Set(client.AccessControlAllowMethods, c.allowedMethods)
+	if c.allowAnyHeader {
+		if requestedHeaders != "" {
+			w.Header().Set(client.AccessControlAllowHeaders, requestedHeaders)
+		}
+	} else {
+		w.Header().Set(client.AccessControlAllowHeaders, c.allowedHeaders)
+	}
+	if c.maxAge != "" {
+		w.Header().Set(client.AccessControlMaxAge, c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Cors) actual(w http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get(client.Origin)
+	if !c.allowAll || c.credentials {
+		w.Header().Add(client.Vary, client.Origin)
+	}
+	if origin == "" || !c.originAllowed(origin) {
+		return
+	}
+	c.setAllowOrigin(w, origin)
+	if c.exposedHeaders != "" {
+		w.Header().Set(client.AccessControlExposeHeaders, c.exposedHeaders)
+	}
+}
+
+// Handler answers preflight requests and decorates actual requests. As a
+// route handler it only sees preflights for routes registered with OPTIONS,
+// use Middleware to answer them for every route.
+func (c *Cors) Handler() ChainHandler {
+	return func(w http.ResponseWriter, req *http.Request) bool {
+		if isPreflight(req) {
+			c.preflight(w, req)
+			return false
+		}
+		c.actual(w, req)
+		return true
+	}
+}
+
+func (c *Cors) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if isPreflight(req) {
+				c.preflight(w, req)
+				return
+			}
+			c.actual(w, req)
+			next.ServeHTTP(w, req)
+		})
+	}
+}
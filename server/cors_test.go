@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+func TestCorsPreflight(t *testing.T) {
+	cors := NewCors(CorsOptions{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		AllowedMethods:   []string{"GET", "POST", "DELETE"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	router, err := NewRouterBuilder().
+		Use(cors.Middleware()).
+		Get("/items", func(w http.ResponseWriter, req *http.Request) {
+			Response(w).WithBody("items").AsTextPlain()
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type testCase struct {
+		origin string
+		method string
+		status int
+		allow  string
+	}
+	cases := []testCase{
+		{"https://app.example.com", "DELETE", http.StatusNoContent, "https://app.example.com"},
+		{"https://api.example.org", "POST", http.StatusNoContent, "https://api.example.org"},
+		{"https://example.org", "POST", http.StatusForbidden, ""},
+		{"https://app.example.com", "PUT", http.StatusForbidden, ""},
+		{"https://evil.com", "GET", http.StatusForbidden, ""},
+	}
+	for _, test := range cases {
+		req := httptest.NewRequest(http.MethodOptions, "/items", nil)
+		req.Header.Set(client.Origin, test.origin)
+		req.Header.Set(client.AccessControlRequestMethod, test.method)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.origin, test.method, rec.Code, test.status)
+		}
+		if got := rec.Header().Get(client.AccessControlAllowOrigin); got != test.allow {
+			t.Errorf("%s %s: got origin %q, want %q", test.origin, test.method, got, test.allow)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/items", nil)
+	req.Header.Set(client.Origin, "https://app.example.com")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Header().Get(client.AccessControlAllowCredentials) != "true" {
+		t.Errorf("expected credentials header on actual request")
+	}
+	if rec.Body.String() != "items" {
+		t.Errorf("got body %q, want %q", rec.Body.String(), "items")
+	}
+}
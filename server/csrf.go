@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"github.com/enolgor/go-utils-mm/cryp"
+)
+
+type CsrfOptions struct {
+	CookieName   string
+	FieldName    string
+	HeaderName   string
+	Path         string
+	Domain       string
+	Secure       bool
+	MaxAge       time.Duration
+	ErrorHandler http.HandlerFunc
+}
+
+func defaultCsrfOptions() CsrfOptions {
+	return CsrfOptions{
+		CookieName: "_csrf",
+		FieldName:  "_csrf",
+		HeaderName: client.XCSRFToken,
+		Path:       "/",
+		MaxAge:     12 * time.Hour,
+	}
+}
+
+// Csrf implements the signed double-submit cookie pattern: a random token is
+// signed with cryp and stored in a cookie, and unsafe requests must echo it
+// back in a header or form field. Tokens are bound to the session and the
+// JWT subject of the request, so a pair minted by someone else, for instance
+// set from a sibling subdomain, is rejected. Handler must run after the auth
+// handlers, and makes new sessions persist so their id can be bound.
+type Csrf struct {
+	signer  cryp.Signer
+	options CsrfOptions
+}
+
+type csrfContextKey int
+
+const csrfTokenKey csrfContextKey = iota
+
+const csrfSessionKey = "_csrf"
+
+type csrfToken struct {
+	token string
+	field string
+}
+
+func NewCsrf(key []byte, options CsrfOptions) *Csrf {
+	def := defaultCsrfOptions()
+	if options.CookieName == "" {
+		options.CookieName = def.CookieName
+	}
+	if options.FieldName == "" {
+		options.FieldName = def.FieldName
+	}
+	if options.HeaderName == "" {
+		options.HeaderName = def.HeaderName
+	}
+	if options.Path == "" {
+		options.Path = def.Path
+	}
+	if options.MaxAge == 0 {
+		options.MaxAge = def.MaxAge
+	}
+	if options.ErrorHandler == nil {
+		options.ErrorHandler = defaultCsrfError
+	}
+	return &Csrf{signer: cryp.HMAC(key), options: options}
+}
+
+var defaultCsrfError = func(w http.ResponseWriter, req *http.Request) {
+	Response(w).Status(http.StatusForbidden).WithBody(Localize(req, "invalid csrf token")).AsTextPlain()
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions || method == http.MethodTrace
+}
+
+func (c *Csrf) Handler() ChainHandler {
+	return func(w http.ResponseWriter, req *http.Request) bool {
+		safe := isSafeMethod(req.Method)
+		binding := c.binding(req, safe)
+		token := c.cookieToken(req)
+		if safe {
+			if !c.bound(token, binding) {
+				token = c.issue(w, binding)
+			}
+			AddContextValue(req, csrfTokenKey, csrfToken{token, c.options.FieldName})
+			return true
+		}
+		if !c.matches(token, c.submittedToken(req), binding) {
+			c.options.ErrorHandler(w, req)
+			return false
+		}
+		AddContextValue(req, csrfTokenKey, csrfToken{token, c.options.FieldName})
+		return true
+	}
+}
+
+// binding hashes the session id and JWT subject the token is issued to. New
+// sessions are only persisted when issuing, as their id changes otherwise.
+func (c *Csrf) binding(req *http.Request, issuing bool) []byte {
+	h := sha256.New()
+	if session := Session(req); session != nil {
+		if issuing && session.IsNew() && !session.Modified() {
+			session.Set(csrfSessionKey, true)
+		}
+		h.Write([]byte(session.ID))
+	}
+	h.Write([]byte{0})
+	if claims := JwtClaims(req); claims != nil {
+		subject, _ := claims.GetSubject()
+		h.Write([]byte(subject))
+	}
+	return h.Sum(nil)
+}
+
+func (c *Csrf) cookieToken(req *http.Request) string {
+	cookie, err := req.Cookie(c.options.CookieName)
+	if err != nil {
+		return ""
+	}
+	if _, err := c.signer.Verify(cookie.Value); err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func (c *Csrf) submittedToken(req *http.Request) string {
+	if token := req.Header.Get(c.options.HeaderName); token != "" {
+		return token
+	}
+	return req.PostFormValue(c.options.FieldName)
+}
+
+// bound reports if the signed token was issued for binding.
+func (c *Csrf) bound(token string, binding []byte) bool {
+	if token == "" {
+		return false
+	}
+	plain, err := c.signer.Verify(token)
+	if err != nil || len(plain) != 32+sha256.Size {
+		return false
+	}
+	return subtle.ConstantTimeCompare(plain[32:], binding) == 1
+}
+
+func (c *Csrf) matches(token, submitted string, binding []byte) bool {
+	return submitted != "" && subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) == 1 && c.bound(token, binding)
+}
+
+func (c *Csrf) issue(w http.ResponseWriter, binding []byte) string {
+	b := make([]byte, 32, 32+len(binding))
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token := c.signer.Sign(append(b, binding...))
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.options.CookieName,
+		Value:    token,
+		Path:     c.options.Path,
+		Domain:   c.options.Domain,
+		Secure:   c.options.Secure,
+		HttpOnly: true,
+		MaxAge:   int(c.options.MaxAge.Seconds()),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+func CsrfToken(req *http.Request) string {
+	var token csrfToken
+	GetContextValue(req, csrfTokenKey, &token)
+	return token.token
+}
+
+func CsrfField(req *http.Request) template.HTML {
+	var token csrfToken
+	if !GetContextValue(req, csrfTokenKey, &token) {
+		return ""
+	}
+	return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+		template.HTMLEscapeString(token.field), template.HTMLEscapeString(token.token)))
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"github.com/enolgor/go-utils-mm/server/sessions"
+)
+
+func TestCsrf(t *testing.T) {
+	csrf := NewCsrf([]byte("secret"), CsrfOptions{})
+	ja := NewJwtAuth([]byte("secret"), time.Hour, nil)
+	soft := ja.SoftAuthHandler()
+	router, err := NewRouterBuilder().
+		Use(Sessions(sessions.NewMemoryStore(time.Minute), SessionOptions{})).
+		Get("/form", Handle(soft, csrf.Handler(), func(w http.ResponseWriter, req *http.Request) {
+			Response(w).WithBody(CsrfToken(req)).AsTextPlain()
+		})).
+		Post("/form", Handle(soft, csrf.Handler(), func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(method string, token string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/form", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		if token != "" {
+			req.Header.Set(client.XCSRFToken, token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	// visit returns the session and csrf cookies and the token of a form.
+	visit := func(cookies ...*http.Cookie) (map[string]*http.Cookie, string) {
+		rec := send(http.MethodGet, "", cookies...)
+		jar := map[string]*http.Cookie{}
+		for _, c := range cookies {
+			jar[c.Name] = c
+		}
+		for _, c := range rec.Result().Cookies() {
+			jar[c.Name] = c
+		}
+		return jar, rec.Body.String()
+	}
+
+	victim, token := visit()
+	if victim["_session"] == nil || victim["_csrf"] == nil || token != victim["_csrf"].Value {
+		t.Fatalf("expected a persisted session and the csrf cookie, got %v", victim)
+	}
+	if rec := send(http.MethodPost, token, victim["_session"], victim["_csrf"]); rec.Code != http.StatusOK {
+		t.Fatalf("expected matching token to be accepted, got %d", rec.Code)
+	}
+	if rec := send(http.MethodPost, "", victim["_session"], victim["_csrf"]); rec.Code != http.StatusForbidden {
+		t.Errorf("expected missing token to be rejected, got %d", rec.Code)
+	}
+	other, otherToken := visit(victim["_session"], victim["_csrf"])
+	if otherToken != token {
+		t.Errorf("expected the token to be kept for the same session")
+	}
+	if rec := send(http.MethodPost, token+"x", other["_session"], other["_csrf"]); rec.Code != http.StatusForbidden {
+		t.Errorf("expected mismatched token to be rejected, got %d", rec.Code)
+	}
+
+	attacker, minted := visit()
+	if rec := send(http.MethodPost, minted, victim["_session"], attacker["_csrf"]); rec.Code != http.StatusForbidden {
+		t.Errorf("expected a pair minted for another session to be rejected, got %d", rec.Code)
+	}
+
+	alice, _ := ja.TokenCookie("alice")
+	bob, _ := ja.TokenCookie("bob")
+	session, aliceToken := visit(victim["_session"], alice)
+	if aliceToken == token {
+		t.Fatal("expected a new token once authenticated")
+	}
+	if rec := send(http.MethodPost, aliceToken, session["_session"], session["_csrf"], alice); rec.Code != http.StatusOK {
+		t.Errorf("expected token bound to alice to be accepted, got %d", rec.Code)
+	}
+	if rec := send(http.MethodPost, aliceToken, session["_session"], session["_csrf"], bob); rec.Code != http.StatusForbidden {
+		t.Errorf("expected token bound to alice to be rejected for bob, got %d", rec.Code)
+	}
+}
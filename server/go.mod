@@ -1,5 +1,17 @@
 module github.com/enolgor/go-utils-mm/server
 
-go 1.20
+go 1.21
 
-require github.com/golang-jwt/jwt/v5 v5.0.0
+require (
+	github.com/enolgor/go-utils-mm/client v0.0.0-00010101000000-000000000000
+	github.com/enolgor/go-utils-mm/cryp v0.0.0-00010101000000-000000000000
+	github.com/golang-jwt/jwt/v5 v5.0.0
+	golang.org/x/text v0.12.0
+)
+
+require golang.org/x/crypto v0.12.0 // indirect
+
+replace (
+	github.com/enolgor/go-utils-mm/client => ../client
+	github.com/enolgor/go-utils-mm/cryp => ../cryp
+)
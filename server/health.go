@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+type HealthCheck func(ctx context.Context) error
+
+type HealthOptions struct {
+	Timeout  time.Duration
+	CacheTTL time.Duration
+}
+
+type healthKind int
+
+const (
+	livenessKind healthKind = iota
+	readinessKind
+)
+
+type registeredCheck struct {
+	name    string
+	check   HealthCheck
+	timeout time.Duration
+}
+
+type CheckResult struct {
+	Name     string        `json:"name"`
+	Healthy  bool          `json:"healthy"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type HealthReport struct {
+	Healthy bool          `json:"healthy"`
+	Checks  []CheckResult `json:"checks"`
+	Time    time.Time     `json:"time"`
+}
+
+type Health struct {
+	options      HealthOptions
+	mu           sync.Mutex
+	checks       map[healthKind][]registeredCheck
+	cache        map[healthKind]*HealthReport
+	shuttingDown atomic.Bool
+}
+
+func NewHealth(options HealthOptions) *Health {
+	if options.Timeout == 0 {
+		options.Timeout = 2 * time.Second
+	}
+	if options.CacheTTL == 0 {
+		options.CacheTTL = time.Second
+	}
+	return &Health{
+		options: options,
+		checks:  map[healthKind][]registeredCheck{},
+		cache:   map[healthKind]*HealthReport{},
+	}
+}
+
+var DefaultHealth = NewHealth(HealthOptions{})
+
+func (h *Health) add(kind healthKind, name string, check HealthCheck, timeout []time.Duration) {
+	t := h.options.Timeout
+	if len(timeout) > 0 {
+		t = timeout[0]
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[kind] = append(h.checks[kind], registeredCheck{name, check, t})
+	// readiness reports include the liveness checks
+	delete(h.cache, kind)
+	delete(h.cache, readinessKind)
+}
+
+// AddLiveness registers a check reported by /healthz, liveness checks are
+// also part of readiness.
+func (h *Health) AddLiveness(name string, check HealthCheck, timeout ...time.Duration) {
+	h.add(livenessKind, name, check, timeout)
+}
+
+func (h *Health) AddReadiness(name string, check HealthCheck, timeout ...time.Duration) {
+	h.add(readinessKind, name, check, timeout)
+}
+
+// ShutdownHook flips readiness to failing, add it to ServerConfig.OnShutdown
+// with a ShutdownDelay longer than the load balancer probe interval so it
+// stops routing before the server drains.
+func (h *Health) ShutdownHook() Hook {
+	return func(ctx context.Context) error {
+		h.shuttingDown.Store(true)
+		return nil
+	}
+}
+
+// run is shared by every caller through the cache, so checks run detached
+// from the cancellation of the request triggering them, bound by their own
+// timeouts.
+func (h *Health) run(ctx context.Context, kind healthKind) *HealthReport {
+	ctx = context.WithoutCancel(ctx)
+	h.mu.Lock()
+	if cached, ok := h.cache[kind]; ok && time.Since(cached.Time) < h.options.CacheTTL {
+		h.mu.Unlock()
+		return cached
+	}
+	checks := append([]registeredCheck{}, h.checks[livenessKind]...)
+	if kind == readinessKind {
+		checks = append(checks, h.checks[readinessKind]...)
+	}
+	h.mu.Unlock()
+
+	report := &HealthReport{Healthy: true, Checks: make([]CheckResult, len(checks)), Time: time.Now()}
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			report.Checks[i] = runCheck(ctx, checks[i])
+		}(i)
+	}
+	wg.Wait()
+	for _, result := range report.Checks {
+		report.Healthy = report.Healthy && result.Healthy
+	}
+	sort.Slice(report.Checks, func(i, j int) bool {
+		return report.Checks[i].Name < report.Checks[j].Name
+	})
+	h.mu.Lock()
+	h.cache[kind] = report
+	h.mu.Unlock()
+	return report
+}
+
+func runCheck(ctx context.Context, check registeredCheck) (result CheckResult) {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+	start := time.Now()
+	result.Name = check.name
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				done <- fmt.Errorf("panic: %v", rec)
+			}
+		}()
+		done <- check.check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("timeout after %s", check.timeout)
+		}
+	}
+	result.Duration = time.Since(start)
+	result.Healthy = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return
+}
+
+func (h *Health) handler(kind healthKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		report := h.run(req.Context(), kind)
+		if kind == readinessKind && h.shuttingDown.Load() {
+			report = &HealthReport{
+				Checks: append([]CheckResult{{Name: "shutdown", Error: "server is shutting down"}}, report.Checks...),
+				Time:   report.Time,
+			}
+		}
+		status := http.StatusOK
+		if !report.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set(client.CacheControl, "no-store")
+		if wantsJson(req) {
+			Response(w).Status(status).WithBody(report).AsJson()
+			return
+		}
+		Response(w).Status(status).WithBody(func(w io.Writer) {
+			for _, result := range report.Checks {
+				if result.Healthy {
+					fmt.Fprintf(w, "[+] %s ok\n", result.Name)
+				} else {
+					fmt.Fprintf(w, "[-] %s failed: %s\n", result.Name, result.Error)
+				}
+			}
+			if report.Healthy {
+				fmt.Fprint(w, "ok\n")
+			} else {
+				fmt.Fprint(w, "failed\n")
+			}
+		}).AsTextPlain()
+	}
+}
+
+func wantsJson(req *http.Request) bool {
+	return req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get(client.Accept), "application/json")
+}
+
+func (h *Health) LivenessHandler() http.HandlerFunc {
+	return h.handler(livenessKind)
+}
+
+func (h *Health) ReadinessHandler() http.HandlerFunc {
+	return h.handler(readinessKind)
+}
+
+func RegisterLiveness(name string, check HealthCheck, timeout ...time.Duration) {
+	DefaultHealth.AddLiveness(name, check, timeout...)
+}
+
+func RegisterReadiness(name string, check HealthCheck, timeout ...time.Duration) {
+	DefaultHealth.AddReadiness(name, check, timeout...)
+}
+
+func LivenessHandler() http.HandlerFunc {
+	return DefaultHealth.LivenessHandler()
+}
+
+func ReadinessHandler() http.HandlerFunc {
+	return DefaultHealth.ReadinessHandler()
+}
+
+// UpstreamCheck probes url with a GET and fails unless it answers with a 2xx
+// or one of the expected statuses.
+func UpstreamCheck(url string, expected ...int) HealthCheck {
+	return func(ctx context.Context) error {
+		resp, err := client.Get(url).WithContext(ctx).Do()
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		for _, status := range expected {
+			if resp.StatusCode == status {
+				return nil
+			}
+		}
+		if len(expected) == 0 && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+}
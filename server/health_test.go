@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	health := NewHealth(HealthOptions{Timeout: 50 * time.Millisecond, CacheTTL: time.Hour})
+	var calls atomic.Int32
+	var failing atomic.Bool
+	health.AddLiveness("process", func(ctx context.Context) error {
+		calls.Add(1)
+		return nil
+	})
+	health.AddReadiness("database", func(ctx context.Context) error {
+		if failing.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	get := func(handler http.HandlerFunc) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/?format=json", nil))
+		return rec
+	}
+	if rec := get(health.ReadinessHandler()); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"name": "process"`) {
+		t.Fatalf("expected healthy readiness including liveness checks, got %d %s", rec.Code, rec.Body)
+	}
+	failing.Store(true)
+	if rec := get(health.ReadinessHandler()); rec.Code != http.StatusOK || calls.Load() != 1 {
+		t.Errorf("expected the cached report within the ttl, got %d after %d runs", rec.Code, calls.Load())
+	}
+	health.AddLiveness("noop", func(ctx context.Context) error { return nil })
+	if rec := get(health.ReadinessHandler()); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "connection refused") {
+		t.Errorf("expected registering a check to drop the cache, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := get(health.LivenessHandler()); rec.Code != http.StatusOK {
+		t.Errorf("expected liveness to ignore readiness checks, got %d", rec.Code)
+	}
+	failing.Store(false)
+	health.AddReadiness("cache", func(ctx context.Context) error { return nil })
+	health.ShutdownHook()(context.Background())
+	if rec := get(health.ReadinessHandler()); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "shutting down") {
+		t.Errorf("expected readiness to fail once shutting down, got %d %s", rec.Code, rec.Body)
+	}
+	if rec := get(health.LivenessHandler()); rec.Code != http.StatusOK {
+		t.Errorf("expected liveness to pass while shutting down, got %d", rec.Code)
+	}
+}
+
+func TestHealthChecksFailures(t *testing.T) {
+	health := NewHealth(HealthOptions{Timeout: 20 * time.Millisecond})
+	health.AddLiveness("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	health.AddLiveness("panics", func(ctx context.Context) error {
+		panic("boom")
+	})
+	report := health.run(context.Background(), livenessKind)
+	if report.Healthy || len(report.Checks) != 2 {
+		t.Fatalf("expected failing checks, got %+v", report)
+	}
+	if report.Checks[0].Error != "panic: boom" || report.Checks[1].Error != "timeout after 20ms" {
+		t.Errorf("unexpected results %+v", report.Checks)
+	}
+}
+
+func TestHealthCallerCancelled(t *testing.T) {
+	health := NewHealth(HealthOptions{CacheTTL: time.Hour})
+	health.AddLiveness("slow", func(ctx context.Context) error {
+		select {
+		case <-time.After(20 * time.Millisecond):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	health.LivenessHandler()(httptest.NewRecorder(), req)
+	rec := httptest.NewRecorder()
+	health.LivenessHandler()(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected a disconnected caller not to cache a failure, got %d %s", rec.Code, rec.Body)
+	}
+}
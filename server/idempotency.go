@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+// IdempotencyRecord is what a store keeps per key, a reservation while the
+// first request is in flight and its response once completed.
+type IdempotencyRecord struct {
+	Fingerprint string
+	Completed   bool
+	Status      int
+	Header      http.Header
+	Body        []byte
+}
+
+type IdempotencyStore interface {
+	// Begin atomically reserves key for a request with fingerprint for lock,
+	// returning nil. If key is already reserved or completed the existing
+	// record is returned instead.
+	Begin(key, fingerprint string, lock time.Duration) (*IdempotencyRecord, error)
+	// Complete replaces the reservation of key with the completed record.
+	Complete(key string, record *IdempotencyRecord, ttl time.Duration) error
+	// Release drops the reservation of key so the request can be retried.
+	Release(key string) error
+}
+
+type idempotencyEntry struct {
+	record  *IdempotencyRecord
+	expires time.Time
+}
+
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{entries: map[string]*idempotencyEntry{}, now: time.Now}
+}
+
+func (ms *memoryIdempotencyStore) Begin(key, fingerprint string, lock time.Duration) (*IdempotencyRecord, error) {
+	now := ms.now()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if now.Sub(ms.lastSweep) > time.Minute {
+		for k, entry := range ms.entries {
+			if now.After(entry.expires) {
+				delete(ms.entries, k)
+			}
+		}
+		ms.lastSweep = now
+	}
+	if entry, ok := ms.entries[key]; ok && !now.After(entry.expires) {
+		return entry.record, nil
+	}
+	ms.entries[key] = &idempotencyEntry{&IdempotencyRecord{Fingerprint: fingerprint}, now.Add(lock)}
+	return nil, nil
+}
+
+func (ms *memoryIdempotencyStore) Complete(key string, record *IdempotencyRecord, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.entries[key] = &idempotencyEntry{record, ms.now().Add(ttl)}
+	return nil
+}
+
+func (ms *memoryIdempotencyStore) Release(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.entries, key)
+	return nil
+}
+
+type IdempotencyOptions struct {
+	Store IdempotencyStore
+	// TTL is how long completed responses are replayed, defaults to 24 hours.
+	TTL time.Duration
+	// LockTimeout bounds how long a key stays reserved by a request that
+	// never completes, defaults to a minute.
+	LockTimeout time.Duration
+	// Scope separates the keys of different clients, requests it returns an
+	// empty scope for are passed through without replay. It defaults to the
+	// JWT subject, so the claims must be set before this middleware runs,
+	// for example with Use(auth.SoftAuthHandler().Middleware(),
+	// Idempotency(options)). Auth attached to the routes with Handle runs
+	// too late, every request is then passed through. Set KeyByIP to replay
+	// for anonymous clients.
+	Scope   func(*http.Request) string
+	Methods []string
+	// Required rejects requests without the header with 400.
+	Required    bool
+	MaxBodySize int64
+}
+
+func subjectScope(req *http.Request) string {
+	if claims := JwtClaims(req); claims != nil {
+		if sub, err := claims.GetSubject(); err == nil && sub != "" {
+			return "sub:" + sub
+		}
+	}
+	return ""
+}
+
+func idempotencyFingerprint(req *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, req.Method+" "+req.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func replayIdempotent(w http.ResponseWriter, record *IdempotencyRecord) {
+	header := w.Header()
+	for k, v := range storedHeader(record.Header) {
+		header[k] = append([]string{}, v...)
+	}
+	header.Set(client.IdempotentReplayed, "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+// Idempotency stores the first response to a request with an Idempotency-Key
+// header and replays it for retries with the same key. Reusing a key with a
+// different payload gets 422 and retrying while the first request is in flight
+// gets 409. Server errors are not stored so they can be retried, and cookies
+// and per-request headers like X-Request-Id are not replayed.
+func Idempotency(options IdempotencyOptions) Middleware {
+	if options.Store == nil {
+		options.Store = NewMemoryIdempotencyStore()
+	}
+	if options.TTL == 0 {
+		options.TTL = 24 * time.Hour
+	}
+	if options.LockTimeout == 0 {
+		options.LockTimeout = time.Minute
+	}
+	if options.Scope == nil {
+		options.Scope = subjectScope
+	}
+	if options.Methods == nil {
+		options.Methods = []string{http.MethodPost, http.MethodPatch}
+	}
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = 1 << 20
+	}
+	methods := map[string]bool{}
+	for _, method := range options.Methods {
+		methods[method] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !methods[req.Method] {
+				next.ServeHTTP(w, req)
+				return
+			}
+			idempotencyKey := req.Header.Get(client.IdempotencyKey)
+			if idempotencyKey == "" {
+				if options.Required {
+					Response(w).Status(http.StatusBadRequest).WithBody(Localize(req, "missing idempotency key")).AsTextPlain()
+					return
+				}
+				next.ServeHTTP(w, req)
+				return
+			}
+			scope := options.Scope(req)
+			if scope == "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if len(idempotencyKey) > 255 {
+				Response(w).Status(http.StatusBadRequest).WithBody(Localize(req, "invalid idempotency key")).AsTextPlain()
+				return
+			}
+			var body []byte
+			if req.Body != nil {
+				var err error
+				body, err = io.ReadAll(io.LimitReader(req.Body, options.MaxBodySize+1))
+				req.Body.Close()
+				if err != nil {
+					Response(w).Status(http.StatusBadRequest).WithBody(Localize(req, "error reading body")).AsTextPlain()
+					return
+				}
+				if int64(len(body)) > options.MaxBodySize {
+					Response(w).Status(http.StatusRequestEntityTooLarge).WithBody(Localize(req, "request body too large")).AsTextPlain()
+					return
+				}
+				req.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			fingerprint := idempotencyFingerprint(req, body)
+			key := scope + "\x00" + idempotencyKey
+			record, err := options.Store.Begin(key, fingerprint, options.LockTimeout)
+			if err != nil {
+				Logger(req).Error("reserving idempotency key", "error", err)
+				Response(w).Status(http.StatusServiceUnavailable).WithBody(Localize(req, "idempotency store unavailable")).AsTextPlain()
+				return
+			}
+			if record != nil {
+				switch {
+				case record.Fingerprint != fingerprint:
+					Response(w).Status(http.StatusUnprocessableEntity).WithBody(Localize(req, "idempotency key reused with a different request")).AsTextPlain()
+				case !record.Completed:
+					Response(w).Status(http.StatusConflict).WithBody(Localize(req, "a request with this idempotency key is in progress")).AsTextPlain()
+				default:
+					replayIdempotent(w, record)
+				}
+				return
+			}
+
+			completed := false
+			defer func() {
+				if !completed {
+					if err := options.Store.Release(key); err != nil {
+						Logger(req).Error("releasing idempotency key", "error", err)
+					}
+				}
+			}()
+			cw := &cacheWriter{responseWriter: wrapResponseWriter(w), max: math.MaxInt64}
+			next.ServeHTTP(cw, req)
+			if cw.header == nil {
+				cw.header = w.Header().Clone()
+			}
+			if cw.Status() >= 500 {
+				return
+			}
+			header := storedHeader(cw.header)
+			header.Del(client.SetCookie)
+			err = options.Store.Complete(key, &IdempotencyRecord{
+				Fingerprint: fingerprint,
+				Completed:   true,
+				Status:      cw.Status(),
+				Header:      header,
+				Body:        cw.body.Bytes(),
+			}, options.TTL)
+			if err != nil {
+				Logger(req).Error("storing idempotent response", "error", err)
+				return
+			}
+			completed = true
+		})
+	}
+}
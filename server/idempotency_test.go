@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+func TestIdempotency(t *testing.T) {
+	var orders atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	var requests atomic.Int32
+	requestID := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set(client.XRequestID, fmt.Sprint(requests.Add(1)))
+			next.ServeHTTP(w, req)
+		})
+	}
+	router, err := NewRouterBuilder().
+		Use(requestID, Idempotency(IdempotencyOptions{Scope: KeyByIP})).
+		Post("/orders", func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Has("slow") {
+				close(started)
+				<-release
+			}
+			if req.URL.Query().Has("fail") {
+				Response(w).Status(http.StatusServiceUnavailable).WithBody("down").AsTextPlain()
+				return
+			}
+			id := orders.Add(1)
+			Response(w).Status(http.StatusCreated).WithHeader("X-Order", fmt.Sprint(id)).WithBody(fmt.Sprintf("order %d", id)).AsTextPlain()
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(client.IdempotencyKey, key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := send("/orders", "k1", "two apples")
+	replay := send("/orders", "k1", "two apples")
+	if first.Code != http.StatusCreated || replay.Code != http.StatusCreated {
+		t.Fatalf("expected 201 twice, got %d and %d", first.Code, replay.Code)
+	}
+	if replay.Body.String() != "order 1" || replay.Header().Get("X-Order") != "1" || replay.Header().Get(client.IdempotentReplayed) != "true" {
+		t.Fatalf("expected the first response to be replayed, got %q %v", replay.Body, replay.Header())
+	}
+	if id := replay.Header().Get(client.XRequestID); id != "2" {
+		t.Errorf("expected the id of the retry, got %q", id)
+	}
+	if rec := send("/orders", "k1", "three apples"); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for a different payload, got %d", rec.Code)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send("/orders?slow", "k2", "pear") }()
+	<-started
+	if rec := send("/orders?slow", "k2", "pear"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 while in flight, got %d", rec.Code)
+	}
+	close(release)
+	if rec := <-done; rec.Code != http.StatusCreated {
+		t.Fatalf("expected the in flight request to complete, got %d", rec.Code)
+	}
+
+	if rec := send("/orders?fail", "k3", "plum"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if rec := send("/orders?fail", "k3", "plum"); rec.Header().Get(client.IdempotentReplayed) != "" {
+		t.Fatal("server errors must not be replayed")
+	}
+	if orders.Load() != 2 {
+		t.Fatalf("expected 2 orders, got %d", orders.Load())
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	ja := NewJwtAuth([]byte("secret"), time.Hour, nil)
+	var orders atomic.Int32
+	order := func(w http.ResponseWriter, req *http.Request) {
+		Response(w).Status(http.StatusCreated).WithBody(fmt.Sprintf("order %d", orders.Add(1))).AsTextPlain()
+	}
+	authenticated, err := NewRouterBuilder().
+		Use(ja.SoftAuthHandler().Middleware(), Idempotency(IdempotencyOptions{})).
+		Post("/orders", order).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous, err := NewRouterBuilder().
+		Use(Idempotency(IdempotencyOptions{})).
+		Post("/orders", order).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(router *Router, key string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader("apples"))
+		req.Header.Set(client.IdempotencyKey, key)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	alice, _ := ja.TokenCookie("alice")
+	bob, _ := ja.TokenCookie("bob")
+	send(authenticated, "shared", alice)
+	if rec := send(authenticated, "shared", bob); rec.Body.String() != "order 2" || rec.Header().Get(client.IdempotentReplayed) != "" {
+		t.Errorf("expected bob's request to not replay alice's response, got %q", rec.Body)
+	}
+	if rec := send(authenticated, "shared", alice); rec.Body.String() != "order 1" || rec.Header().Get(client.IdempotentReplayed) != "true" {
+		t.Errorf("expected alice's response to be replayed to her, got %q", rec.Body)
+	}
+
+	send(anonymous, "shared", alice)
+	if rec := send(anonymous, "shared", bob); rec.Body.String() != "order 4" || rec.Header().Get(client.IdempotentReplayed) != "" {
+		t.Errorf("expected no replay without a subject, got %q", rec.Body)
+	}
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var asymmetricMethods = []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+}
+
+func (sk *SigningKey) Public() crypto.PublicKey {
+	return sk.Private.Public()
+}
+
+func newKeyID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// NewSigningKey wraps an RSA, P-256 ECDSA or Ed25519 private key, picking
+// RS256, ES256 or EdDSA. A random id is used when id is empty.
+func NewSigningKey(id string, private crypto.Signer) (*SigningKey, error) {
+	if id == "" {
+		id = newKeyID()
+	}
+	var method jwt.SigningMethod
+	switch key := private.(type) {
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+		method = jwt.SigningMethodES256
+	case ed25519.PrivateKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+	return &SigningKey{ID: id, Method: method, Private: private}, nil
+}
+
+// GenerateSigningKey creates a key for alg, one of RS256, ES256 or EdDSA.
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case jwt.SigningMethodRS256.Alg():
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey("", private)
+}
+
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+func publicJWK(kid, alg string, public crypto.PublicKey) JSONWebKey {
+	jwk := JSONWebKey{Kid: kid, Use: "sig", Alg: alg}
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64.EncodeToString(key.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk.Kty, jwk.Crv = "EC", "P-256"
+		x, y := make([]byte, 32), make([]byte, 32)
+		jwk.X = b64.EncodeToString(key.X.FillBytes(x))
+		jwk.Y = b64.EncodeToString(key.Y.FillBytes(y))
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv = "OKP", "Ed25519"
+		jwk.X = b64.EncodeToString(key)
+	}
+	return jwk
+}
+
+// PublicKey decodes the key, returning it with the algorithm it verifies.
+func (jwk JSONWebKey) PublicKey() (crypto.PublicKey, string, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := b64.DecodeString(s)
+		return new(big.Int).SetBytes(b), err
+	}
+	switch {
+	case jwk.Kty == "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, "", err
+		}
+		e, err := decode(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, "", fmt.Errorf("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, jwt.SigningMethodRS256.Alg(), nil
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, "", err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, "", err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, "", fmt.Errorf("invalid ec point")
+		}
+		return key, jwt.SigningMethodES256.Alg(), nil
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		x, err := b64.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, "", fmt.Errorf("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), jwt.SigningMethodEdDSA.Alg(), nil
+	}
+	return nil, "", fmt.Errorf("unsupported key type %s %s", jwk.Kty, jwk.Crv)
+}
+
+type retiredKey struct {
+	key     *SigningKey
+	retired time.Time
+}
+
+// KeySet holds the key tokens are signed with and the retired keys still
+// published so tokens signed before a rotation remain valid.
+type KeySet struct {
+	mu      sync.RWMutex
+	current *SigningKey
+	retired []retiredKey
+	retain  time.Duration
+	now     func() time.Time
+}
+
+// NewKeySet signs with key and keeps retired keys for retain, which should be
+// at least the lifetime of the tokens.
+func NewKeySet(key *SigningKey, retain time.Duration) *KeySet {
+	return &KeySet{current: key, retain: retain, now: time.Now}
+}
+
+func (ks *KeySet) Current() *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.current
+}
+
+// Add makes key the signing key, retiring the current one.
+func (ks *KeySet) Add(key *SigningKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	now := ks.now()
+	ks.retired = append(ks.retired, retiredKey{ks.current, now})
+	ks.current = key
+	kept := ks.retired[:0]
+	for _, r := range ks.retired {
+		if now.Sub(r.retired) < ks.retain {
+			kept = append(kept, r)
+		}
+	}
+	ks.retired = kept
+}
+
+// Rotate replaces the signing key with a new one of the same algorithm.
+func (ks *KeySet) Rotate() error {
+	key, err := GenerateSigningKey(ks.Current().Method.Alg())
+	if err != nil {
+		return err
+	}
+	ks.Add(key)
+	return nil
+}
+
+// RotateEvery rotates the signing key every interval until ctx is done.
+func (ks *KeySet) RotateEvery(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := ks.Rotate(); err != nil {
+					slog.Default().Error("rotating signing key", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+func (ks *KeySet) lookup(kid string) *SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if ks.current.ID == kid {
+		return ks.current
+	}
+	for _, r := range ks.retired {
+		if r.key.ID == kid && ks.now().Sub(r.retired) < ks.retain {
+			return r.key
+		}
+	}
+	return nil
+}
+
+func (ks *KeySet) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := ks.lookup(kid)
+	if key == nil || key.Method.Alg() != token.Method.Alg() {
+		return nil, ErrUnknownKey
+	}
+	return key.Public(), nil
+}
+
+func (ks *KeySet) JWKS() JSONWebKeySet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	set := JSONWebKeySet{Keys: []JSONWebKey{publicJWK(ks.current.ID, ks.current.Method.Alg(), ks.current.Public())}}
+	for _, r := range ks.retired {
+		if ks.now().Sub(r.retired) < ks.retain {
+			set.Keys = append(set.Keys, publicJWK(r.key.ID, r.key.Method.Alg(), r.key.Public()))
+		}
+	}
+	return set
+}
+
+// Handler serves the public keys as a JWK set, to be mounted at
+// /.well-known/jwks.json.
+func (ks *KeySet) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		Response(w).WithHeader(client.CacheControl, "public, max-age=300").WithBody(ks.JWKS()).AsJson()
+	}
+}
+
+type remoteKey struct {
+	public crypto.PublicKey
+	alg    string
+}
+
+// RemoteKeySet verifies tokens with the keys published by another service,
+// fetched with the client package and cached for the max-age of the response
+// or ttl. Unknown key ids trigger a refresh, at most once every minRefresh.
+// Refreshes run one at a time without blocking tokens signed with known keys,
+// which are verified with the current set meanwhile.
+type RemoteKeySet struct {
+	url        string
+	ttl        time.Duration
+	minRefresh time.Duration
+	mu         sync.Mutex
+	keys       map[string]remoteKey
+	expires    time.Time
+	lastFetch  time.Time
+	refreshing chan struct{}
+	err        error
+	now        func() time.Time
+}
+
+func NewRemoteKeySet(url string, ttl, minRefresh time.Duration) *RemoteKeySet {
+	return &RemoteKeySet{url: url, ttl: ttl, minRefresh: minRefresh, now: time.Now}
+}
+
+func (rks *RemoteKeySet) fetch() (map[string]remoteKey, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := client.Get(rks.url).WithContext(ctx).Do()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("fetching jwks: status %d", resp.StatusCode)
+	}
+	var set JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, time.Time{}, fmt.Errorf("fetching jwks: %w", err)
+	}
+	keys := map[string]remoteKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		public, alg, err := jwk.PublicKey()
+		if err != nil || (jwk.Alg != "" && jwk.Alg != alg) {
+			continue
+		}
+		keys[jwk.Kid] = remoteKey{public, alg}
+	}
+	ttl := rks.ttl
+	if maxAge, ok := parseCacheControl(resp.Header.Get(client.CacheControl))["max-age"]; ok {
+		if secs, err := strconv.Atoi(maxAge); err == nil {
+			ttl = time.Duration(secs) * time.Second
+		}
+	}
+	return keys, rks.now().Add(ttl), nil
+}
+
+// refresh fetches the keys without holding the lock and closes done once
+// the set is updated.
+func (rks *RemoteKeySet) refresh(done chan struct{}) {
+	keys, expires, err := rks.fetch()
+	rks.mu.Lock()
+	if err == nil {
+		rks.keys, rks.expires = keys, expires
+	}
+	rks.err = err
+	rks.refreshing = nil
+	rks.mu.Unlock()
+	close(done)
+}
+
+func (rks *RemoteKeySet) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	rks.mu.Lock()
+	now := rks.now()
+	key, ok := rks.keys[kid]
+	if (!ok || now.After(rks.expires)) && rks.refreshing == nil && now.Sub(rks.lastFetch) >= rks.minRefresh {
+		rks.lastFetch = now
+		rks.refreshing = make(chan struct{})
+		go rks.refresh(rks.refreshing)
+	}
+	refreshing := rks.refreshing
+	rks.mu.Unlock()
+	if !ok && refreshing != nil {
+		<-refreshing
+		rks.mu.Lock()
+		key, ok = rks.keys[kid]
+		err := rks.err
+		if rks.keys == nil && err != nil {
+			rks.mu.Unlock()
+			return nil, err
+		}
+		rks.mu.Unlock()
+	}
+	if !ok || key.alg != token.Method.Alg() {
+		return nil, ErrUnknownKey
+	}
+	return key.public, nil
+}
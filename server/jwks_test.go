@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJwks(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		key, err := GenerateSigningKey(alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock := &fakeClock{time.Now()}
+		keys := NewKeySet(key, time.Hour)
+		keys.now = clock.now
+		issuer := NewJwtAuthWithKeys(keys, time.Hour, nil)
+
+		var fetches atomic.Int32
+		jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fetches.Add(1)
+			keys.Handler()(w, req)
+		}))
+		remote := NewRemoteKeySet(jwks.URL, time.Hour, 0)
+		verifier := NewRemoteJwtAuth(remote)
+
+		verify := func(ja *JwtAuth, cookie *http.Cookie) int {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(cookie)
+			rec := httptest.NewRecorder()
+			if ja.StrictAuthHandler("/login")(rec, req) {
+				return http.StatusOK
+			}
+			return rec.Code
+		}
+		old, err := issuer.TokenCookie("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := verify(verifier, old); status != http.StatusOK {
+			t.Fatalf("%s: expected remote verification, got %d", alg, status)
+		}
+		if err := keys.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		rotated, _ := issuer.TokenCookie("alice")
+		for _, cookie := range []*http.Cookie{old, rotated} {
+			if verify(issuer, cookie) != http.StatusOK || verify(verifier, cookie) != http.StatusOK {
+				t.Fatalf("%s: expected tokens from current and retired keys to verify", alg)
+			}
+		}
+		if fetches.Load() != 2 {
+			t.Fatalf("%s: expected a refresh for the new kid only, got %d fetches", alg, fetches.Load())
+		}
+		clock.t = clock.t.Add(2 * time.Hour)
+		if verify(issuer, old) == http.StatusOK {
+			t.Fatalf("%s: expected tokens of expired keys to be rejected", alg)
+		}
+		jwks.Close()
+	}
+}
+
+func TestRemoteKeySetRefresh(t *testing.T) {
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewKeySet(key, time.Hour)
+	issuer := NewJwtAuthWithKeys(keys, time.Hour, nil)
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		keys.Handler()(w, req)
+	}))
+	defer jwks.Close()
+	remote := NewRemoteKeySet(jwks.URL, time.Hour, 0)
+	verifier := NewRemoteJwtAuth(remote)
+	verify := func(cookie *http.Cookie) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		return verifier.StrictAuthHandler("/login")(httptest.NewRecorder(), req)
+	}
+
+	old, _ := issuer.TokenCookie("alice")
+	if !verify(old) {
+		t.Fatal("expected remote verification")
+	}
+	if err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := issuer.TokenCookie("alice")
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !verify(rotated) {
+				t.Error("expected the new key to be fetched")
+			}
+		}()
+	}
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan bool)
+	go func() { done <- verify(old) }()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("expected the known key to verify during the refresh")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected known keys to be served while refreshing")
+	}
+	close(release)
+	wg.Wait()
+	if fetches.Load() != 2 {
+		t.Errorf("expected concurrent unknown kids to share one fetch, got %d", fetches.Load())
+	}
+
+	form := url.Values{"user": {"alice"}, "pass": {"pw"}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	verifier.LoginHandler()(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected logins to be rejected by a verify only auth, got %d", rec.Code)
+	}
+}
+
+func TestJwtAlgorithmConfusion(t *testing.T) {
+	key, _ := GenerateSigningKey("RS256")
+	ja := NewJwtAuthWithKeys(NewKeySet(key, time.Hour), time.Hour, nil)
+	public, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "mallory",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	forged.Header["kid"] = key.ID
+	for _, secret := range [][]byte{public, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})} {
+		tkn, _ := forged.SignedString(secret)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: jwtCookieName, Value: tkn})
+		if ja.StrictAuthHandler("/login")(httptest.NewRecorder(), req) {
+			t.Fatal("accepted an hmac token signed with the public key")
+		}
+	}
+}
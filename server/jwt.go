@@ -1,7 +1,12 @@
 package server
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
 	"strings"
@@ -12,39 +17,179 @@ import (
 
 type JwtAuth struct {
 	parser     *jwt.Parser
+	methods    []string
+	validation JwtValidationOptions
 	key        []byte
+	keys       *KeySet
+	remote     *RemoteKeySet
 	expiration time.Duration
 	verifyUser func(user, pass string) (bool, error)
+	principal  func(user, pass string) (*Principal, error)
+	refreshed  func(*Principal) (*Principal, error)
+	store      TokenStore
+	refreshTTL time.Duration
+	transport  JwtTransportOptions
 }
 
 const jwtCookieName string = "_token"
+const refreshCookieName string = "_refresh"
+
+var ErrTokenRevoked = errors.New("token revoked")
 
 type jwtContextKey int
 
-const contextJwtClaims jwtContextKey = iota
+const (
+	contextJwtClaims jwtContextKey = iota
+	contextJwtError
+)
 
 func NewJwtAuth(key []byte, expiration time.Duration, verifyUser func(user, pass string) (bool, error)) *JwtAuth {
-	return &JwtAuth{
-		parser:     jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name})),
+	return (&JwtAuth{
+		methods:    []string{jwt.SigningMethodHS256.Name},
 		key:        key,
 		expiration: expiration,
 		verifyUser: verifyUser,
+	}).WithTransport(JwtTransportOptions{}).WithValidation(JwtValidationOptions{})
+}
+
+// NewJwtAuthWithKeys signs tokens with the current key of keys, so they can be
+// verified by other services with the keys published by KeySet.Handler.
+func NewJwtAuthWithKeys(keys *KeySet, expiration time.Duration, verifyUser func(user, pass string) (bool, error)) *JwtAuth {
+	return (&JwtAuth{
+		methods:    asymmetricMethods,
+		keys:       keys,
+		expiration: expiration,
+		verifyUser: verifyUser,
+	}).WithTransport(JwtTransportOptions{}).WithValidation(JwtValidationOptions{})
+}
+
+// NewRemoteJwtAuth only verifies tokens, signed by the service publishing
+// the remote key set.
+func NewRemoteJwtAuth(remote *RemoteKeySet) *JwtAuth {
+	return (&JwtAuth{}).WithTransport(JwtTransportOptions{}).WithValidation(JwtValidationOptions{}).VerifyWith(remote)
+}
+
+// VerifyWith also accepts tokens signed with the keys of remote.
+func (ja *JwtAuth) VerifyWith(remote *RemoteKeySet) *JwtAuth {
+	ja.remote = remote
+	ja.methods = asymmetricMethods
+	if ja.key != nil {
+		ja.methods = append([]string{jwt.SigningMethodHS256.Name}, ja.methods...)
+	}
+	ja.parser = ja.newParser()
+	return ja
+}
+
+// WithTokenStore rejects access tokens revoked in store by LogoutHandler. A
+// positive refreshTTL also makes LoginHandler issue refresh tokens, rotated
+// by RefreshHandler, so the access token expiration can be kept short.
+func (ja *JwtAuth) WithTokenStore(store TokenStore, refreshTTL time.Duration) *JwtAuth {
+	ja.store = store
+	ja.refreshTTL = refreshTTL
+	return ja
+}
+
+// WithPrincipals authenticates logins with principal instead of verifyUser,
+// issuing tokens with the roles, scopes and claims of the principal returned,
+// nil if the credentials are invalid. Logins are rejected when neither is
+// set, as with NewRemoteJwtAuth.
+func (ja *JwtAuth) WithPrincipals(principal func(user, pass string) (*Principal, error)) *JwtAuth {
+	ja.principal = principal
+	return ja
+}
+
+// WithRefreshPrincipals resolves the principal of a refresh token again on
+// every refresh, so role, scope and claim changes apply within the access
+// token expiration, and returning nil ends the session revoking its family.
+// Without it refreshed tokens keep the principal of the login until the
+// refresh token expires.
+func (ja *JwtAuth) WithRefreshPrincipals(principal func(*Principal) (*Principal, error)) *JwtAuth {
+	ja.refreshed = principal
+	return ja
+}
+
+func (ja *JwtAuth) authenticate(user, pass string) (*Principal, error) {
+	if ja.principal != nil {
+		return ja.principal(user, pass)
+	}
+	if ja.verifyUser == nil {
+		return nil, nil
+	}
+	if ok, err := ja.verifyUser(user, pass); err != nil || !ok {
+		return nil, err
+	}
+	return &Principal{Subject: user}, nil
+}
+
+// keyfunc never returns the shared secret for asymmetric algorithms nor a
+// public key for HMAC, so the alg header can't be used to confuse them.
+func (ja *JwtAuth) keyfunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if ja.key == nil {
+			return nil, ErrUnknownKey
+		}
+		return ja.key, nil
+	}
+	if ja.keys != nil {
+		if key, err := ja.keys.Keyfunc(token); err == nil {
+			return key, nil
+		}
 	}
+	if ja.remote != nil {
+		return ja.remote.Keyfunc(token)
+	}
+	return nil, ErrUnknownKey
+}
+
+func (ja *JwtAuth) sign(claims jwt.Claims) (string, error) {
+	if ja.keys != nil {
+		key := ja.keys.Current()
+		tkn := jwt.NewWithClaims(key.Method, claims)
+		tkn.Header["kid"] = key.ID
+		return tkn.SignedString(key.Private)
+	}
+	if ja.key == nil {
+		return "", ErrUnknownKey
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ja.key)
+}
+
+func (ja *JwtAuth) parse(jwtString string) (*jwt.Token, error) {
+	tkn, err := ja.parser.Parse(jwtString, ja.keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if err := ja.validate(tkn.Claims.(jwt.MapClaims)); err != nil {
+		return nil, err
+	}
+	if ja.store == nil {
+		return tkn, nil
+	}
+	if revoked, err := ja.store.IsRevoked(tokenID(tkn.Claims)); err != nil {
+		return nil, err
+	} else if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return tkn, nil
+}
+
+func tokenID(claims jwt.Claims) string {
+	if mc, ok := claims.(jwt.MapClaims); ok {
+		jti, _ := mc["jti"].(string)
+		return jti
+	}
+	return ""
 }
 
 func (ja *JwtAuth) SoftAuthHandler() ChainHandler {
 	return func(w http.ResponseWriter, req *http.Request) bool {
 		var jwtString string
-		if jwtString = getJwtString(req); jwtString == "" {
+		if jwtString = ja.tokenString(req); jwtString == "" {
 			return true
 		}
-		tkn, err := ja.parser.Parse(jwtString, func(token *jwt.Token) (interface{}, error) {
-			return ja.key, nil
-		})
+		tkn, err := ja.parse(jwtString)
 		if err != nil {
-			return true
-		}
-		if !tkn.Valid {
+			AddContextValue(req, contextJwtError, err)
 			return true
 		}
 		AddContextValue(req, contextJwtClaims, tkn.Claims)
@@ -54,31 +199,22 @@ func (ja *JwtAuth) SoftAuthHandler() ChainHandler {
 
 func (ja *JwtAuth) StrictAuthHandler(redirect string) ChainHandler {
 	return func(w http.ResponseWriter, req *http.Request) bool {
-		if !strings.Contains(redirect, "redirect") {
-			if strings.Contains(redirect, "?") {
-				redirect = fmt.Sprintf("%s&redirect=%s", redirect, url.QueryEscape(req.URL.Path))
+		target := redirect
+		if !strings.Contains(target, "redirect") {
+			if strings.Contains(target, "?") {
+				target = fmt.Sprintf("%s&redirect=%s", target, url.QueryEscape(req.URL.Path))
 			} else {
-				redirect = fmt.Sprintf("%s?redirect=%s", redirect, url.QueryEscape(req.URL.Path))
+				target = fmt.Sprintf("%s?redirect=%s", target, url.QueryEscape(req.URL.Path))
 			}
 		}
 		var jwtString string
-		if jwtString = getJwtString(req); jwtString == "" {
-			Response(w).Status(http.StatusUnauthorized).Redirect(redirect)
+		if jwtString = ja.tokenString(req); jwtString == "" {
+			Response(w).Status(rejectToken(w, req, ErrTokenMissing)).Redirect(target)
 			return false
 		}
-		tkn, err := ja.parser.Parse(jwtString, func(token *jwt.Token) (interface{}, error) {
-			return ja.key, nil
-		})
+		tkn, err := ja.parse(jwtString)
 		if err != nil {
-			if err == jwt.ErrSignatureInvalid {
-				Response(w).Status(http.StatusUnauthorized).Redirect(redirect)
-				return false
-			}
-			Response(w).Status(http.StatusBadRequest).Redirect(redirect)
-			return false
-		}
-		if !tkn.Valid {
-			Response(w).Status(http.StatusUnauthorized).Redirect(redirect)
+			Response(w).Status(rejectToken(w, req, err)).Redirect(target)
 			return false
 		}
 		AddContextValue(req, contextJwtClaims, tkn.Claims)
@@ -88,11 +224,9 @@ func (ja *JwtAuth) StrictAuthHandler(redirect string) ChainHandler {
 
 func (ja *JwtAuth) LoginHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		var redirect, user, pass string
+		var user, pass string
 		var err error
-		if redirect = req.URL.Query().Get("redirect"); redirect == "" {
-			redirect = "/"
-		}
+		redirect := localRedirect(req.URL.Query().Get("redirect"))
 		if err = req.ParseForm(); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -105,66 +239,215 @@ func (ja *JwtAuth) LoginHandler() http.HandlerFunc {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		if ok, err := ja.verifyUser(user, pass); err != nil {
+		principal, err := ja.authenticate(user, pass)
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
-		} else if !ok {
+		} else if principal == nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		expiration := time.Now().Add(ja.expiration)
-		claims := jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expiration),
-			Subject:   user,
+		if err := ja.issue(w, principal, ""); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+		Response(w).Redirect(redirect)
+	}
+}
 
-		tkn, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ja.key)
+// RefreshHandler exchanges the refresh token cookie for a new access token
+// and a new refresh token, responding 204 or redirecting to the redirect
+// query parameter. Presenting a refresh token that was already exchanged
+// revokes its whole family, as either it or its successor was stolen.
+func (ja *JwtAuth) RefreshHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		cook, err := req.Cookie(ja.transport.RefreshCookieName)
+		if err != nil || ja.store == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token, err := ja.store.UseRefresh(refreshID(cook.Value))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if token == nil || token.Used {
+			if token != nil {
+				Logger(req).Warn("refresh token reused, revoking family", "subject", token.Principal.Subject)
+				if err := ja.store.RevokeFamily(token.Family); err != nil {
+					Logger(req).Error("revoking refresh tokens", "error", err)
+				}
+			}
+			ja.clearCookies(w)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		principal := token.Principal
+		if ja.refreshed != nil {
+			if principal, err = ja.refreshed(token.Principal); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if principal == nil {
+				if err := ja.store.RevokeFamily(token.Family); err != nil {
+					Logger(req).Error("revoking refresh tokens", "error", err)
+				}
+				ja.clearCookies(w)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		if err := ja.issue(w, principal, token.Family); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if redirect := req.URL.Query().Get("redirect"); redirect != "" {
+			Response(w).Redirect(localRedirect(redirect))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// LogoutHandler clears the token cookies, revoking the access token and the
+// refresh token family when a store is configured, and redirects to redirect.
+func (ja *JwtAuth) LogoutHandler(redirect string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if ja.store != nil {
+			if err := ja.revoke(req); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		ja.clearCookies(w)
+		Response(w).Redirect(redirect)
+	}
+}
+
+func (ja *JwtAuth) revoke(req *http.Request) error {
+	if jwtString := ja.tokenString(req); jwtString != "" {
+		if tkn, err := ja.parse(jwtString); err == nil {
+			if jti := tokenID(tkn.Claims); jti != "" {
+				exp, _ := tkn.Claims.GetExpirationTime()
+				if exp == nil {
+					exp = jwt.NewNumericDate(ja.validation.Now().Add(ja.expiration))
+				}
+				if err := ja.store.Revoke(jti, exp.Time); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if cook, err := req.Cookie(ja.transport.RefreshCookieName); err == nil {
+		token, err := ja.store.UseRefresh(refreshID(cook.Value))
+		if err != nil {
+			return err
+		}
+		if token != nil {
+			return ja.store.RevokeFamily(token.Family)
+		}
+	}
+	return nil
+}
+
+// issue sets the access token cookie for principal and, when refresh tokens
+// are enabled, a refresh token of family, starting a new one if empty.
+func (ja *JwtAuth) issue(w http.ResponseWriter, principal *Principal, family string) error {
+	cookie, err := ja.PrincipalCookie(principal)
+	if err != nil {
+		return err
+	}
+	if ja.store != nil && ja.refreshTTL > 0 {
+		if family == "" {
+			family = newRequestID()
 		}
-		Response(w).
-			WithCookie(&http.Cookie{
-				Name:     jwtCookieName,
-				Value:    tkn,
-				HttpOnly: true,
-				Expires:  expiration,
-				SameSite: http.SameSiteStrictMode,
-			}).
-			Redirect(redirect)
+		value := randomToken()
+		expiration := ja.validation.Now().Add(ja.refreshTTL)
+		if err := ja.store.SaveRefresh(&RefreshToken{
+			ID:        refreshID(value),
+			Family:    family,
+			Principal: principal,
+			Expires:   expiration,
+		}); err != nil {
+			return err
+		}
+		http.SetCookie(w, ja.cookie(ja.transport.RefreshCookieName, value, expiration))
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
 	}
+	return b64.EncodeToString(b)
+}
+
+// refreshID is the key refresh tokens are stored by, so a leaked store
+// doesn't hand out usable tokens.
+func refreshID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// TokenCookie issues a token for subject and returns the cookie carrying it,
+// as set by LoginHandler.
+func (ja *JwtAuth) TokenCookie(subject string) (*http.Cookie, error) {
+	return ja.PrincipalCookie(&Principal{Subject: subject})
+}
+
+// PrincipalCookie is TokenCookie for a principal with roles, scopes or claims.
+func (ja *JwtAuth) PrincipalCookie(principal *Principal) (*http.Cookie, error) {
+	now := ja.validation.Now()
+	claims := principal.claims()
+	ja.issueClaims(claims, now)
+	tkn, err := ja.sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	return ja.cookie(ja.transport.CookieName, tkn, now.Add(ja.expiration)), nil
 }
 
 func (ja *JwtAuth) SampleAuthForm(target, defaultRedirect string) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		redirect := defaultRedirect
 		if req.URL.Query().Has("redirect") {
-			defaultRedirect = req.URL.Query().Get("redirect")
+			redirect = localRedirect(req.URL.Query().Get("redirect"))
 		}
 		if HasContextValue[jwt.Claims](req, contextJwtClaims) {
-			Response(w).Redirect(defaultRedirect)
+			Response(w).Redirect(redirect)
 			return
 		}
 
-		Response(w).WithBody(fmt.Sprintf(`
-		<!DOCTYPE html>
-		<html lang="en">
-			<head>
-				<meta charset="UTF-8">
-			</head>
-			<body>
-				<form action="%s?redirect=%s" method="post">
-					<label for="user">User:</label>
-					<input type="text" id="user" name="user"><br><br>
-					<label for="pass">Password:</label>
-					<input type="password" id="pass" name="pass"><br><br>
-					<input type="submit" value="Authenticate">
-				</form>
-			</body>
-		</html>
-		`, target, defaultRedirect)).AsHtml()
+		Response(w).WithTemplate(req, sampleAuthForm, struct {
+			Target   string
+			Redirect string
+		}{target, redirect}).AsHtml()
 	}
 }
 
+var sampleAuthForm = template.Must(template.New("auth").Parse(`
+<!DOCTYPE html>
+<html lang="en">
+	<head>
+		<meta charset="UTF-8">
+	</head>
+	<body>
+		<form action="{{.Data.Target}}?redirect={{.Data.Redirect}}" method="post">
+			{{.CsrfField}}
+			<label for="user">User:</label>
+			<input type="text" id="user" name="user"><br><br>
+			<label for="pass">Password:</label>
+			<input type="password" id="pass" name="pass"><br><br>
+			<input type="submit" value="Authenticate">
+		</form>
+	</body>
+</html>
+`))
+
 func JwtClaims(req *http.Request) jwt.Claims {
 	var claims jwt.Claims
 	if ok := GetContextValue(req, contextJwtClaims, &claims); ok {
@@ -172,18 +455,3 @@ func JwtClaims(req *http.Request) jwt.Claims {
 	}
 	return nil
 }
-
-func getJwtString(req *http.Request) string {
-	if cook, err := req.Cookie(jwtCookieName); err == nil {
-		return cook.Value
-	}
-	header := req.Header.Get("Authentication")
-	if header == "" {
-		return ""
-	}
-	idx := strings.Index(header, "Bearer ")
-	if idx != 0 {
-		return ""
-	}
-	return header[7:]
-}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJwtRefreshAndLogout(t *testing.T) {
+	ja := NewJwtAuth([]byte("secret"), time.Minute, func(user, pass string) (bool, error) {
+		return user == "alice" && pass == "pw", nil
+	}).WithTokenStore(NewMemoryTokenStore(), time.Hour)
+
+	cookies := func(rec *httptest.ResponseRecorder) map[string]*http.Cookie {
+		m := map[string]*http.Cookie{}
+		for _, c := range rec.Result().Cookies() {
+			m[c.Name] = c
+		}
+		return m
+	}
+	login := func() map[string]*http.Cookie {
+		form := url.Values{"user": {"alice"}, "pass": {"pw"}}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		ja.LoginHandler()(rec, req)
+		return cookies(rec)
+	}
+	call := func(handler http.HandlerFunc, sent ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		for _, c := range sent {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	authorized := func(access *http.Cookie) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(access)
+		return ja.StrictAuthHandler("/login")(httptest.NewRecorder(), req)
+	}
+
+	first := login()
+	if first[jwtCookieName] == nil || first[refreshCookieName] == nil {
+		t.Fatal("expected access and refresh cookies on login")
+	}
+	rec := call(ja.RefreshHandler(), first[refreshCookieName])
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected refresh to succeed, got %d", rec.Code)
+	}
+	second := cookies(rec)
+	if second[refreshCookieName].Value == first[refreshCookieName].Value || !authorized(second[jwtCookieName]) {
+		t.Fatal("expected a rotated refresh token and a valid access token")
+	}
+	if rec := call(ja.RefreshHandler(), first[refreshCookieName]); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected reused refresh token to be rejected, got %d", rec.Code)
+	}
+	if rec := call(ja.RefreshHandler(), second[refreshCookieName]); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected reuse to revoke the family, got %d", rec.Code)
+	}
+
+	session := login()
+	if !authorized(session[jwtCookieName]) {
+		t.Fatal("expected a valid access token")
+	}
+	rec = call(ja.LogoutHandler("/"), session[jwtCookieName], session[refreshCookieName])
+	if cleared := cookies(rec); cleared[jwtCookieName] == nil || cleared[jwtCookieName].MaxAge >= 0 {
+		t.Fatal("expected logout to clear the token cookie")
+	}
+	if authorized(session[jwtCookieName]) {
+		t.Fatal("expected revoked access token to be rejected")
+	}
+	if rec := call(ja.RefreshHandler(), session[refreshCookieName]); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected logout to revoke the refresh token, got %d", rec.Code)
+	}
+}
+
+func TestJwtRedirects(t *testing.T) {
+	ja := NewJwtAuth([]byte("secret"), time.Minute, func(user, pass string) (bool, error) {
+		return user == "alice" && pass == "pw", nil
+	}).WithTokenStore(NewMemoryTokenStore(), time.Hour)
+	login := func(redirect string) *httptest.ResponseRecorder {
+		form := url.Values{"user": {"alice"}, "pass": {"pw"}}
+		req := httptest.NewRequest(http.MethodPost, "/login?redirect="+url.QueryEscape(redirect), strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		ja.LoginHandler()(rec, req)
+		return rec
+	}
+	refresh := func(redirect string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/refresh?redirect="+url.QueryEscape(redirect), nil)
+		for _, c := range login("/").Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		ja.RefreshHandler()(rec, req)
+		return rec
+	}
+	alice, _ := ja.TokenCookie("alice")
+	form := func(redirect string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/form?redirect="+url.QueryEscape(redirect), nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		Handle(ja.SoftAuthHandler(), ja.SampleAuthForm("/login", "/home"))(rec, req)
+		return rec
+	}
+
+	type testCase struct {
+		redirect string
+		expected string
+	}
+	testCases := []testCase{
+		{"/orders", "/orders"},
+		{"https://evil.example/", "/"},
+		{"//evil.example/", "/"},
+		{"/\\evil.example/", "/"},
+	}
+	for _, tc := range testCases {
+		for name, rec := range map[string]*httptest.ResponseRecorder{
+			"login":   login(tc.redirect),
+			"refresh": refresh(tc.redirect),
+			"form":    form(tc.redirect, alice),
+		} {
+			body := rec.Body.String()
+			if rec.Code != http.StatusOK || strings.Contains(body, "evil") || !strings.Contains(body, `"`+tc.expected+`"`) {
+				t.Errorf("%s with %q: expected redirect to %q, got %d %s", name, tc.redirect, tc.expected, rec.Code, body)
+			}
+		}
+	}
+	form("https://evil.example/")
+	req := httptest.NewRequest(http.MethodGet, "/form", nil)
+	rec := httptest.NewRecorder()
+	ja.SampleAuthForm("/login", "/home")(rec, req)
+	if body := rec.Body.String(); strings.Contains(body, "evil") || !strings.Contains(body, "redirect=%2fhome") {
+		t.Errorf("expected the form to keep its default redirect, got %s", body)
+	}
+}
+
+func TestJwtLogoutWithoutStore(t *testing.T) {
+	ja := NewJwtAuth([]byte("secret"), time.Minute, nil)
+	token, _ := ja.TokenCookie("alice")
+	req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	req.AddCookie(token)
+	rec := httptest.NewRecorder()
+	ja.LogoutHandler("/bye")(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"/bye"`) {
+		t.Fatalf("expected a redirect after logout, got %d %s", rec.Code, rec.Body)
+	}
+	cleared := false
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == jwtCookieName && c.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Error("expected logout to clear the token cookie")
+	}
+}
+
+func TestJwtRefreshPrincipals(t *testing.T) {
+	roles := map[string][]string{"alice": {"admin"}}
+	ja := NewJwtAuth([]byte("secret"), time.Minute, nil).
+		WithPrincipals(func(user, pass string) (*Principal, error) {
+			return &Principal{Subject: user, Roles: roles[user]}, nil
+		}).
+		WithRefreshPrincipals(func(p *Principal) (*Principal, error) {
+			granted, ok := roles[p.Subject]
+			if !ok {
+				return nil, nil
+			}
+			return &Principal{Subject: p.Subject, Roles: granted}, nil
+		}).
+		WithTokenStore(NewMemoryTokenStore(), time.Hour)
+	form := url.Values{"user": {"alice"}, "pass": {"pw"}}
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	ja.LoginHandler()(rec, req)
+	refresh := func(cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+		for _, c := range cookies {
+			if c.Name == refreshCookieName {
+				req.AddCookie(c)
+			}
+		}
+		rec := httptest.NewRecorder()
+		ja.RefreshHandler()(rec, req)
+		return rec
+	}
+	isAdmin := func(cookies []*http.Cookie) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range cookies {
+			if c.Name == jwtCookieName {
+				req.AddCookie(c)
+			}
+		}
+		return ja.SoftAuthHandler()(httptest.NewRecorder(), req) && contains(Roles(req), "admin")
+	}
+
+	if !isAdmin(rec.Result().Cookies()) {
+		t.Fatal("expected the login roles to be issued")
+	}
+	roles["alice"] = []string{"staff"}
+	rec = refresh(rec.Result().Cookies())
+	if rec.Code != http.StatusNoContent || isAdmin(rec.Result().Cookies()) {
+		t.Fatalf("expected refresh to issue the current roles, got %d", rec.Code)
+	}
+	delete(roles, "alice")
+	if rec := refresh(rec.Result().Cookies()); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected refresh of a removed principal to be rejected, got %d", rec.Code)
+	}
+}
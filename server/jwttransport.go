@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+type TokenSource int
+
+const (
+	// FromCookie reads the token cookie.
+	FromCookie TokenSource = iota
+	// FromAuthorization reads an Authorization: Bearer header.
+	FromAuthorization
+	// FromHeader reads the raw token from JwtTransportOptions.Header.
+	FromHeader
+	// FromQuery reads JwtTransportOptions.QueryParam. Query strings end up in
+	// logs and browser history, use it only where headers can't be set, like
+	// websocket or server-sent event connections.
+	FromQuery
+)
+
+type JwtTransportOptions struct {
+	// CookieName defaults to _token, RefreshCookieName to _refresh.
+	CookieName        string
+	RefreshCookieName string
+	Path              string
+	Domain            string
+	Secure            bool
+	// HostPrefix prefixes the cookie names with __Host- so browsers only
+	// accept them when set by this host over HTTPS, forcing Secure, the root
+	// Path and no Domain.
+	HostPrefix bool
+	// SameSite defaults to strict.
+	SameSite http.SameSite
+	// Sources are tried in order until one carries a token, defaults to the
+	// cookie then the Authorization header.
+	Sources    []TokenSource
+	Header     string
+	QueryParam string
+}
+
+const hostPrefix = "__Host-"
+
+func defaultJwtTransportOptions() JwtTransportOptions {
+	return JwtTransportOptions{
+		CookieName:        jwtCookieName,
+		RefreshCookieName: refreshCookieName,
+		Path:              "/",
+		SameSite:          http.SameSiteStrictMode,
+		Sources:           []TokenSource{FromCookie, FromAuthorization},
+		QueryParam:        "access_token",
+	}
+}
+
+// WithTransport sets the cookies issued and where tokens are read from.
+func (ja *JwtAuth) WithTransport(options JwtTransportOptions) *JwtAuth {
+	def := defaultJwtTransportOptions()
+	if options.CookieName == "" {
+		options.CookieName = def.CookieName
+	}
+	if options.RefreshCookieName == "" {
+		options.RefreshCookieName = def.RefreshCookieName
+	}
+	if options.Path == "" {
+		options.Path = def.Path
+	}
+	if options.SameSite == 0 {
+		options.SameSite = def.SameSite
+	}
+	if options.Sources == nil {
+		options.Sources = def.Sources
+	}
+	if options.QueryParam == "" {
+		options.QueryParam = def.QueryParam
+	}
+	if options.HostPrefix {
+		for _, name := range []*string{&options.CookieName, &options.RefreshCookieName} {
+			if !strings.HasPrefix(*name, hostPrefix) {
+				*name = hostPrefix + *name
+			}
+		}
+		options.Secure = true
+		options.Path = "/"
+		options.Domain = ""
+	}
+	ja.transport = options
+	return ja
+}
+
+func (ja *JwtAuth) cookie(name, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     ja.transport.Path,
+		Domain:   ja.transport.Domain,
+		Secure:   ja.transport.Secure,
+		HttpOnly: true,
+		Expires:  expires,
+		SameSite: ja.transport.SameSite,
+	}
+}
+
+func (ja *JwtAuth) clearCookies(w http.ResponseWriter) {
+	for _, name := range []string{ja.transport.CookieName, ja.transport.RefreshCookieName} {
+		cookie := ja.cookie(name, "", time.Time{})
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+	}
+}
+
+func (ja *JwtAuth) tokenString(req *http.Request) string {
+	for _, source := range ja.transport.Sources {
+		var token string
+		switch source {
+		case FromCookie:
+			if cook, err := req.Cookie(ja.transport.CookieName); err == nil {
+				token = cook.Value
+			}
+		case FromAuthorization:
+			token = bearerToken(req.Header.Get(client.Authorization))
+		case FromHeader:
+			if ja.transport.Header != "" {
+				token = strings.TrimSpace(req.Header.Get(ja.transport.Header))
+			}
+		case FromQuery:
+			token = req.URL.Query().Get(ja.transport.QueryParam)
+		}
+		if token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// bearerToken parses an RFC 6750 Authorization header, whose scheme is case
+// insensitive.
+func bearerToken(header string) string {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJwtTransport(t *testing.T) {
+	ja := NewJwtAuth([]byte("secret"), time.Hour, nil).WithTransport(JwtTransportOptions{
+		CookieName: "app",
+		HostPrefix: true,
+		Domain:     "example.com",
+		Sources:    []TokenSource{FromHeader, FromAuthorization, FromCookie, FromQuery},
+		Header:     "X-Access-Token",
+	})
+	cookie, err := ja.TokenCookie("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie.Name != "__Host-app" || !cookie.Secure || cookie.Path != "/" || cookie.Domain != "" {
+		t.Fatalf("expected a __Host- cookie, got %s", cookie)
+	}
+	bob, _ := ja.TokenCookie("bob")
+
+	subject := func(setup func(req *http.Request)) string {
+		req := httptest.NewRequest(http.MethodGet, "/?access_token="+cookie.Value, nil)
+		setup(req)
+		if !ja.SoftAuthHandler()(httptest.NewRecorder(), req) || JwtClaims(req) == nil {
+			return ""
+		}
+		sub, _ := JwtClaims(req).GetSubject()
+		return sub
+	}
+	type testCase struct {
+		name     string
+		setup    func(req *http.Request)
+		expected string
+	}
+	cases := []testCase{
+		{"query", func(req *http.Request) {}, "alice"},
+		{"cookie over query", func(req *http.Request) { req.AddCookie(&http.Cookie{Name: cookie.Name, Value: bob.Value}) }, "bob"},
+		{"bearer over cookie", func(req *http.Request) {
+			req.AddCookie(cookie)
+			req.Header.Set("Authorization", "bearer "+bob.Value)
+		}, "bob"},
+		{"header over bearer", func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+cookie.Value)
+			req.Header.Set("X-Access-Token", bob.Value)
+		}, "bob"},
+		{"other schemes ignored", func(req *http.Request) {
+			req.URL.RawQuery = ""
+			req.Header.Set("Authorization", "Basic "+bob.Value)
+			req.Header.Set("Authentication", "Bearer "+bob.Value)
+		}, ""},
+	}
+	for _, c := range cases {
+		if sub := subject(c.setup); sub != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expected, sub)
+		}
+	}
+}
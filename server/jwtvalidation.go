@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type JwtValidationOptions struct {
+	// Issuer is set as iss on issued tokens and required on verified ones.
+	Issuer string
+	// Audience is set as aud on issued tokens, verified tokens must be meant
+	// for at least one of them.
+	Audience []string
+	// Leeway tolerates clock skew when checking exp, nbf and iat.
+	Leeway time.Duration
+	// RequiredClaims must be present in verified tokens, defaults to exp.
+	RequiredClaims []string
+	Now            func() time.Time
+}
+
+var ErrTokenMissing = errors.New("token missing")
+
+// WithValidation sets the claims issued tokens carry and verified tokens are
+// checked against.
+func (ja *JwtAuth) WithValidation(options JwtValidationOptions) *JwtAuth {
+	if options.RequiredClaims == nil {
+		options.RequiredClaims = []string{"exp"}
+	}
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	ja.validation = options
+	ja.parser = ja.newParser()
+	return ja
+}
+
+func (ja *JwtAuth) newParser() *jwt.Parser {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(ja.methods),
+		jwt.WithLeeway(ja.validation.Leeway),
+		jwt.WithTimeFunc(ja.validation.Now),
+		jwt.WithIssuedAt(),
+	}
+	if ja.validation.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(ja.validation.Issuer))
+	}
+	return jwt.NewParser(opts...)
+}
+
+// validate checks what the parser can't: an audience out of several and the
+// required claims.
+func (ja *JwtAuth) validate(claims jwt.MapClaims) error {
+	for _, claim := range ja.validation.RequiredClaims {
+		if _, ok := claims[claim]; !ok {
+			return fmt.Errorf("%w: %w %s", jwt.ErrTokenInvalidClaims, jwt.ErrTokenRequiredClaimMissing, claim)
+		}
+	}
+	if len(ja.validation.Audience) == 0 {
+		return nil
+	}
+	aud, err := claims.GetAudience()
+	if err != nil {
+		return fmt.Errorf("%w: %w", jwt.ErrTokenInvalidClaims, err)
+	}
+	for _, a := range aud {
+		if contains(ja.validation.Audience, a) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %w", jwt.ErrTokenInvalidClaims, jwt.ErrTokenInvalidAudience)
+}
+
+// issueClaims adds the registered claims of a token issued now.
+func (ja *JwtAuth) issueClaims(claims jwt.MapClaims, now time.Time) {
+	if ja.validation.Issuer != "" {
+		claims["iss"] = ja.validation.Issuer
+	}
+	if len(ja.validation.Audience) > 0 {
+		claims["aud"] = jwt.ClaimStrings(ja.validation.Audience)
+	}
+	claims["exp"] = jwt.NewNumericDate(now.Add(ja.expiration))
+	claims["iat"] = jwt.NewNumericDate(now)
+	claims["nbf"] = jwt.NewNumericDate(now)
+	claims["jti"] = newRequestID()
+}
+
+// JwtError returns why the token sent with req was rejected, nil if it was
+// accepted or SoftAuthHandler found none. It wraps the errors of the jwt
+// package, ErrTokenMissing or ErrTokenRevoked, so the reason can be told
+// apart with errors.Is.
+func JwtError(req *http.Request) error {
+	var err error
+	GetContextValue(req, contextJwtError, &err)
+	return err
+}
+
+// rejectToken records err and sets the RFC 6750 challenge, returning the
+// status the rejection should be answered with.
+func rejectToken(w http.ResponseWriter, req *http.Request, err error) int {
+	AddContextValue(req, contextJwtError, err)
+	if errors.Is(err, ErrTokenMissing) {
+		w.Header().Set(client.WWWAuthenticate, "Bearer")
+		return http.StatusUnauthorized
+	}
+	Logger(req).Debug("rejected token", "error", err)
+	if errors.Is(err, jwt.ErrTokenMalformed) {
+		w.Header().Set(client.WWWAuthenticate, fmt.Sprintf("Bearer error=%q, error_description=%q", "invalid_request", err.Error()))
+		return http.StatusBadRequest
+	}
+	w.Header().Set(client.WWWAuthenticate, fmt.Sprintf("Bearer error=%q, error_description=%q", "invalid_token", err.Error()))
+	return http.StatusUnauthorized
+}
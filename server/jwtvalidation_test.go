@@ -0,0 +1,75 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJwtValidation(t *testing.T) {
+	clock := &fakeClock{time.Now()}
+	key := []byte("secret")
+	issuer := NewJwtAuth(key, time.Minute, nil).WithValidation(JwtValidationOptions{
+		Issuer:   "https://auth.example.com",
+		Audience: []string{"api", "web"},
+		Now:      clock.now,
+	})
+	verifier := func(options JwtValidationOptions) *JwtAuth {
+		options.Now = clock.now
+		return NewJwtAuth(key, time.Minute, nil).WithValidation(options)
+	}
+	cookie, err := issuer.TokenCookie("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(cookie.Value, claims, func(*jwt.Token) (any, error) { return key, nil }, jwt.WithTimeFunc(clock.now)); err != nil {
+		t.Fatal(err)
+	}
+	for _, claim := range []string{"iss", "aud", "exp", "iat", "nbf", "jti", "sub"} {
+		if _, ok := claims[claim]; !ok {
+			t.Errorf("expected issued token to carry %s", claim)
+		}
+	}
+
+	web := JwtValidationOptions{Issuer: "https://auth.example.com", Audience: []string{"web"}, Leeway: 30 * time.Second}
+	type testCase struct {
+		name     string
+		verifier *JwtAuth
+		token    string
+		skew     time.Duration
+		status   int
+		reason   error
+	}
+	cases := []testCase{
+		{"valid", verifier(web), cookie.Value, 0, http.StatusOK, nil},
+		{"within leeway", verifier(web), cookie.Value, time.Minute + 20*time.Second, http.StatusOK, nil},
+		{"expired", verifier(web), cookie.Value, time.Minute + 40*time.Second, http.StatusUnauthorized, jwt.ErrTokenExpired},
+		{"not yet valid", verifier(web), cookie.Value, -time.Minute, http.StatusUnauthorized, jwt.ErrTokenNotValidYet},
+		{"issuer", verifier(JwtValidationOptions{Issuer: "https://other.example.com"}), cookie.Value, 0, http.StatusUnauthorized, jwt.ErrTokenInvalidIssuer},
+		{"audience", verifier(JwtValidationOptions{Audience: []string{"admin"}}), cookie.Value, 0, http.StatusUnauthorized, jwt.ErrTokenInvalidAudience},
+		{"required claim", verifier(JwtValidationOptions{RequiredClaims: []string{"exp", "roles"}}), cookie.Value, 0, http.StatusUnauthorized, jwt.ErrTokenRequiredClaimMissing},
+		{"malformed", verifier(web), "not.a.token", 0, http.StatusBadRequest, jwt.ErrTokenMalformed},
+		{"missing", verifier(web), "", 0, http.StatusUnauthorized, ErrTokenMissing},
+	}
+	start := clock.t
+	for _, c := range cases {
+		clock.t = start.Add(c.skew)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.token != "" {
+			req.AddCookie(&http.Cookie{Name: jwtCookieName, Value: c.token})
+		}
+		rec := httptest.NewRecorder()
+		status := http.StatusOK
+		if !c.verifier.StrictAuthHandler("/login")(rec, req) {
+			status = rec.Code
+		}
+		if status != c.status || !errors.Is(JwtError(req), c.reason) || (c.reason == nil) != (JwtError(req) == nil) {
+			t.Errorf("%s: expected %d %v, got %d %v", c.name, c.status, c.reason, status, JwtError(req))
+		}
+	}
+}
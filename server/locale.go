@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+)
+
+// LoadCatalog builds a catalog from the JSON files at the root of fsys, each
+// named after its language tag, e.g. "es.json" or "pt-BR.json", and holding an
+// object mapping message keys to their translation. The keys are fmt formats,
+// the default messages of this package use their english text as key.
+func LoadCatalog(fsys fs.FS, fallback language.Tag) (catalog.Catalog, error) {
+	builder := catalog.NewBuilder(catalog.Fallback(fallback))
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		tag, err := language.Parse(strings.TrimSuffix(path.Base(file), ".json"))
+		if err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", file, err)
+		}
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", file, err)
+		}
+		for key, msg := range messages {
+			if err := builder.SetString(tag, key, msg); err != nil {
+				return nil, fmt.Errorf("catalog %s: %w", file, err)
+			}
+		}
+	}
+	return builder, nil
+}
+
+type LocaleOptions struct {
+	// Supported are the available languages, the first one is used when none
+	// matches.
+	Supported []language.Tag
+	Catalog   catalog.Catalog
+	// CookieName and QueryParam let users override Accept-Language, the query
+	// param taking precedence. Both default to "lang".
+	CookieName string
+	QueryParam string
+}
+
+type localeContextKey int
+
+const (
+	languageKey localeContextKey = iota
+	printerKey
+)
+
+// Locale negotiates the language of the response and stores it, with a
+// message printer for it, in the request context.
+func Locale(options LocaleOptions) Middleware {
+	if len(options.Supported) == 0 {
+		options.Supported = []language.Tag{language.English}
+	}
+	if options.Catalog == nil {
+		options.Catalog = message.DefaultCatalog
+	}
+	if options.CookieName == "" {
+		options.CookieName = "lang"
+	}
+	if options.QueryParam == "" {
+		options.QueryParam = "lang"
+	}
+	matcher := language.NewMatcher(options.Supported)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var preferred []language.Tag
+			if lang := req.URL.Query().Get(options.QueryParam); lang != "" {
+				if tag, err := language.Parse(lang); err == nil {
+					preferred = append(preferred, tag)
+				}
+			}
+			if c, err := req.Cookie(options.CookieName); err == nil {
+				if tag, err := language.Parse(c.Value); err == nil {
+					preferred = append(preferred, tag)
+				}
+			}
+			if accept, _, err := language.ParseAcceptLanguage(req.Header.Get(client.AcceptLanguage)); err == nil {
+				preferred = append(preferred, accept...)
+			}
+			_, index, _ := matcher.Match(preferred...)
+			tag := options.Supported[index]
+			AddContextValue(req, languageKey, tag)
+			AddContextValue(req, printerKey, message.NewPrinter(tag, message.Catalog(options.Catalog)))
+			header := w.Header()
+			header.Set(client.ContentLanguage, tag.String())
+			header.Add(client.Vary, client.AcceptLanguage)
+			header.Add(client.Vary, client.Cookie)
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// Language returns the language negotiated by Locale, english when the
+// request didn't go through it.
+func Language(req *http.Request) language.Tag {
+	tag := language.English
+	GetContextValue(req, languageKey, &tag)
+	return tag
+}
+
+// Printer returns the message printer for the language of the request.
+func Printer(req *http.Request) *message.Printer {
+	var printer *message.Printer
+	if GetContextValue(req, printerKey, &printer) {
+		return printer
+	}
+	return message.NewPrinter(Language(req))
+}
+
+// Localize translates the message key with the printer of the request.
+func Localize(req *http.Request, key string, args ...any) string {
+	return Printer(req).Sprintf(key, args...)
+}
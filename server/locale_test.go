@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"golang.org/x/text/language"
+)
+
+func TestLocale(t *testing.T) {
+	cat, err := LoadCatalog(fstest.MapFS{
+		"es.json": {Data: []byte(`{"hello %s": "hola %s", "%s %s not found": "%s %s no encontrado"}`)},
+		"fr.json": {Data: []byte(`{"hello %s": "bonjour %s"}`)},
+	}, language.English)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouterBuilder().
+		Use(Locale(LocaleOptions{Supported: []language.Tag{language.English, language.Spanish, language.French}, Catalog: cat})).
+		Get("/hello", func(w http.ResponseWriter, req *http.Request) {
+			Response(w).WithBody(Localize(req, "hello %s", "ana")).AsTextPlain()
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type testCase struct {
+		path   string
+		accept string
+		cookie string
+		lang   string
+		body   string
+	}
+	cases := []testCase{
+		{"/hello", "es-MX,es;q=0.9,en;q=0.5", "", "es", "hola ana"},
+		{"/hello", "de-DE", "", "en", "hello ana"},
+		{"/hello", "es", "fr", "fr", "bonjour ana"},
+		{"/hello?lang=es", "fr", "fr", "es", "hola ana"},
+		{"/missing", "es", "", "es", "GET /missing no encontrado"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		req.Header.Set(client.AcceptLanguage, c.accept)
+		if c.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "lang", Value: c.cookie})
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if lang := rec.Header().Get(client.ContentLanguage); lang != c.lang || rec.Body.String() != c.body {
+			t.Fatalf("%s %s %s: expected %s %q, got %s %q", c.path, c.accept, c.cookie, c.lang, c.body, lang, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+const redacted = "[REDACTED]"
+
+type LogOptions struct {
+	Logger *slog.Logger
+	Level  slog.Level
+	// RequestIDHeader is read to propagate the id of upstream services and
+	// written back in the response.
+	RequestIDHeader string
+	// Headers lists the request headers added to every access record.
+	Headers []string
+	// RedactHeaders are logged with their value replaced, defaults to
+	// Authorization and Cookie.
+	RedactHeaders []string
+	// RedactFields replaces the value of any attribute with one of these keys
+	// in the access records and in the loggers returned by Logger.
+	RedactFields []string
+}
+
+type logContextKey int
+
+const (
+	requestIDKey logContextKey = iota
+	loggerKey
+)
+
+func AccessLog(options LogOptions) Middleware {
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+	if options.RequestIDHeader == "" {
+		options.RequestIDHeader = client.XRequestID
+	}
+	if options.RedactHeaders == nil {
+		options.RedactHeaders = []string{client.Authorization, client.Cookie}
+	}
+	redactHeaders := map[string]bool{}
+	for _, header := range options.RedactHeaders {
+		redactHeaders[client.NormalizeHeader(header)] = true
+	}
+	logger := options.Logger
+	if len(options.RedactFields) > 0 {
+		fields := map[string]bool{}
+		for _, field := range options.RedactFields {
+			fields[field] = true
+		}
+		logger = slog.New(&redactHandler{logger.Handler(), fields})
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			id := req.Header.Get(options.RequestIDHeader)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(options.RequestIDHeader, id)
+			AddContextValue(req, requestIDKey, id)
+			requestAttrs := []any{
+				slog.String("request_id", id),
+				slog.String("method", req.Method),
+				slog.String("path", req.URL.Path),
+			}
+			if span := Span(req); span != nil {
+				requestAttrs = append(requestAttrs, slog.String("trace_id", span.TraceID.String()))
+			}
+			AddContextValue(req, loggerKey, logger.With(requestAttrs...))
+			rw := wrapResponseWriter(w)
+			next.ServeHTTP(rw, req)
+
+			attrs := []slog.Attr{
+				slog.String("request_id", id),
+				slog.String("method", req.Method),
+				slog.String("route", RouteExpr(req)),
+				slog.String("path", req.URL.Path),
+				slog.Int("status", rw.Status()),
+				slog.Int64("bytes", rw.bytes),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("client_ip", ClientIP(req)),
+			}
+			if span := Span(req); span != nil {
+				attrs = append(attrs, slog.String("trace_id", span.TraceID.String()), slog.String("span_id", span.SpanID.String()))
+			}
+			if claims := JwtClaims(req); claims != nil {
+				if sub, err := claims.GetSubject(); err == nil {
+					attrs = append(attrs, slog.String("sub", sub))
+				}
+			}
+			if len(options.Headers) > 0 {
+				headers := make([]any, 0, len(options.Headers))
+				for _, header := range options.Headers {
+					header = client.NormalizeHeader(header)
+					value := req.Header.Get(header)
+					if value != "" && redactHeaders[header] {
+						value = redacted
+					}
+					headers = append(headers, slog.String(header, value))
+				}
+				attrs = append(attrs, slog.Group("headers", headers...))
+			}
+			level := options.Level
+			if rw.Status() >= 500 {
+				level = slog.LevelError
+			}
+			logger.LogAttrs(req.Context(), level, "request", attrs...)
+		})
+	}
+}
+
+func RequestID(req *http.Request) string {
+	var id string
+	GetContextValue(req, requestIDKey, &id)
+	return id
+}
+
+// Logger returns a logger carrying the request attributes, or the default
+// logger when the request didn't go through AccessLog.
+func Logger(req *http.Request) *slog.Logger {
+	var logger *slog.Logger
+	if GetContextValue(req, loggerKey, &logger) {
+		return logger
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	return strings.IndexFunc(id, func(r rune) bool {
+		return r < 0x21 || r > 0x7e
+	}) == -1
+}
+
+type redactHandler struct {
+	slog.Handler
+	fields map[string]bool
+}
+
+func (h *redactHandler) redact(attr slog.Attr) slog.Attr {
+	if h.fields[attr.Key] {
+		return slog.String(attr.Key, redacted)
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		group := attr.Value.Group()
+		attrs := make([]any, len(group))
+		for i := range group {
+			attrs[i] = h.redact(group[i])
+		}
+		return slog.Group(attr.Key, attrs...)
+	}
+	return attr
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	clean := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		clean.AddAttrs(h.redact(attr))
+		return true
+	})
+	return h.Handler.Handle(ctx, clean)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clean := make([]slog.Attr, len(attrs))
+	for i := range attrs {
+		clean[i] = h.redact(attrs[i])
+	}
+	return &redactHandler{h.Handler.WithAttrs(clean), h.fields}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{h.Handler.WithGroup(name), h.fields}
+}
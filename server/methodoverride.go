@@ -0,0 +1,62 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+type MethodOverrideOptions struct {
+	// Methods that can be requested, defaults to PUT, PATCH and DELETE.
+	Methods   []string
+	Header    string
+	FormField string
+}
+
+// MethodOverride lets POST requests ask to be routed as another method, with
+// the X-HTTP-Method-Override header or the _method form field, so plain HTML
+// forms can reach PUT and DELETE routes. It must be installed with
+// RouterBuilder.Use so the method is rewritten before routes are matched.
+// Overrides to methods not allowed are rejected with 400.
+func MethodOverride(options MethodOverrideOptions) Middleware {
+	if options.Methods == nil {
+		options.Methods = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+	}
+	if options.Header == "" {
+		options.Header = client.XHTTPMethodOverride
+	}
+	if options.FormField == "" {
+		options.FormField = "_method"
+	}
+	allowed := map[string]bool{}
+	for _, method := range options.Methods {
+		allowed[strings.ToUpper(method)] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodPost {
+				next.ServeHTTP(w, req)
+				return
+			}
+			method := req.Header.Get(options.Header)
+			if method == "" {
+				if ct, _, _ := mime.ParseMediaType(req.Header.Get(client.ContentType)); ct == "application/x-www-form-urlencoded" || ct == "multipart/form-data" {
+					method = req.PostFormValue(options.FormField)
+				}
+			}
+			if method == "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+			method = strings.ToUpper(method)
+			if !allowed[method] {
+				Response(w).Status(http.StatusBadRequest).WithBody(Localize(req, "method override not allowed")).AsTextPlain()
+				return
+			}
+			req.Method = method
+			next.ServeHTTP(w, req)
+		})
+	}
+}
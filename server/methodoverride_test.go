@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+func TestMethodOverride(t *testing.T) {
+	router, err := NewRouterBuilder().
+		Use(MethodOverride(MethodOverrideOptions{})).
+		Post("/items/:id", func(w http.ResponseWriter, req *http.Request) {
+			Response(w).WithBody("post").AsTextPlain()
+		}).
+		Delete("/items/:id", func(w http.ResponseWriter, req *http.Request) {
+			Response(w).WithBody("delete " + req.PostFormValue("reason")).AsTextPlain()
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type testCase struct {
+		method string
+		header string
+		form   url.Values
+		status int
+		body   string
+	}
+	cases := []testCase{
+		{http.MethodPost, "", url.Values{"_method": {"delete"}, "reason": {"sold"}}, http.StatusOK, "delete sold"},
+		{http.MethodPost, "DELETE", nil, http.StatusOK, "delete "},
+		{http.MethodPost, "", url.Values{"reason": {"sold"}}, http.StatusOK, "post"},
+		{http.MethodPost, "CONNECT", nil, http.StatusBadRequest, "method override not allowed"},
+		{http.MethodGet, "DELETE", nil, http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/items/1", strings.NewReader(c.form.Encode()))
+		if c.form != nil {
+			req.Header.Set(client.ContentType, "application/x-www-form-urlencoded")
+		}
+		if c.header != "" {
+			req.Header.Set(client.XHTTPMethodOverride, c.header)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != c.status || (c.body != "" && rec.Body.String() != c.body) {
+			t.Fatalf("%s %s %v: expected %d %q, got %d %q", c.method, c.header, c.form, c.status, c.body, rec.Code, rec.Body)
+		}
+	}
+}
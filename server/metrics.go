@@ -0,0 +1,312 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+const (
+	counterKind   = "counter"
+	gaugeKind     = "gauge"
+	histogramKind = "histogram"
+)
+
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type series struct {
+	values []string
+	value  float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*series
+}
+
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string{}, values...)}
+		if f.kind == histogramKind {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) write(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != histogramKind {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.values, "", ""), formatValue(s.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.values, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.values, "", ""), s.count)
+	}
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, names[i], escapeLabel(values[i])))
+	}
+	if extraName != "" {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type Counter struct {
+	f *family
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.f.name))
+	}
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.get(labelValues).value += v
+}
+
+type Gauge struct {
+	f *family
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.get(labelValues).value = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.get(labelValues).value += v
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+type Histogram struct {
+	f *family
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(labelValues)
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+type MetricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{families: map[string]*family{}}
+}
+
+var DefaultMetrics = NewMetricsRegistry()
+
+// register returns the family already registered under name when it has the
+// same kind and labels, so instrumentation can be set up more than once.
+func (r *MetricsRegistry) register(name, help, kind string, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if f.kind != kind || strings.Join(f.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metric %s already registered as %s with labels %v", name, f.kind, f.labels))
+		}
+		return f
+	}
+	f := &family{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: map[string]*series{}}
+	r.families[name] = f
+	return f
+}
+
+func (r *MetricsRegistry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, counterKind, nil, labels)}
+}
+
+func (r *MetricsRegistry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, gaugeKind, nil, labels)}
+}
+
+func (r *MetricsRegistry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{r.register(name, help, histogramKind, buckets, labels)}
+}
+
+func (r *MetricsRegistry) Expose(w io.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		r.mu.Lock()
+		f := r.families[name]
+		r.mu.Unlock()
+		f.write(w)
+	}
+}
+
+func (r *MetricsRegistry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		Response(w).WithBody(func(w io.Writer) { r.Expose(w) }).As("text/plain; version=0.0.4; charset=utf-8")
+	}
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return DefaultMetrics.NewCounter(name, help, labels...)
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return DefaultMetrics.NewGauge(name, help, labels...)
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return DefaultMetrics.NewHistogram(name, help, buckets, labels...)
+}
+
+func MetricsHandler() http.HandlerFunc {
+	return DefaultMetrics.Handler()
+}
+
+func statusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+func RouterMetrics() Middleware {
+	return DefaultMetrics.RouterMetrics()
+}
+
+// RouterMetrics counts and times every request by method, route expression
+// and status class.
+func (r *MetricsRegistry) RouterMetrics() Middleware {
+	requests := r.NewCounter("http_server_requests_total", "Total HTTP requests handled.", "method", "route", "status")
+	latency := r.NewHistogram("http_server_request_duration_seconds", "HTTP request latency in seconds.", nil, "method", "route", "status")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			rw := wrapResponseWriter(w)
+			next.ServeHTTP(rw, req)
+			route := RouteExpr(req)
+			if route == "" {
+				route = "unmatched"
+			}
+			status := statusClass(rw.Status())
+			requests.Inc(req.Method, route, status)
+			latency.Observe(time.Since(start).Seconds(), req.Method, route, status)
+		})
+	}
+}
+
+func ClientMetrics() client.Interceptor {
+	return DefaultMetrics.ClientMetrics()
+}
+
+// ClientMetrics counts and times outbound requests made with client.Request,
+// register it with client.Intercept.
+func (r *MetricsRegistry) ClientMetrics() client.Interceptor {
+	requests := r.NewCounter("http_client_requests_total", "Total outbound HTTP requests.", "method", "host", "status")
+	latency := r.NewHistogram("http_client_request_duration_seconds", "Outbound HTTP request latency in seconds.", nil, "method", "host", "status")
+	return func(next client.Doer) client.Doer {
+		return func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next(req)
+			status := "error"
+			if err == nil {
+				status = statusClass(resp.StatusCode)
+			}
+			requests.Inc(req.Method, req.URL.Host, status)
+			latency.Observe(time.Since(start).Seconds(), req.Method, req.URL.Host, status)
+			return resp, err
+		}
+	}
+}
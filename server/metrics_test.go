@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	registry := NewMetricsRegistry()
+	registry.NewCounter("jobs_total", "Jobs processed.", "queue").Add(3, `a"b`)
+	registry.NewGauge("workers", "Active workers.").Set(2)
+	latency := registry.NewHistogram("job_seconds", "Job latency.", []float64{1, 0.5}, "queue")
+	latency.Observe(0.25, "q")
+	latency.Observe(0.75, "q")
+	buf := &bytes.Buffer{}
+	registry.Expose(buf)
+	expected := `# HELP job_seconds Job latency.
+# TYPE job_seconds histogram
+job_seconds_bucket{queue="q",le="0.5"} 1
+job_seconds_bucket{queue="q",le="1"} 2
+job_seconds_bucket{queue="q",le="+Inf"} 2
+job_seconds_sum{queue="q"} 1
+job_seconds_count{queue="q"} 2
+# HELP jobs_total Jobs processed.
+# TYPE jobs_total counter
+jobs_total{queue="a\"b"} 3
+# HELP workers Active workers.
+# TYPE workers gauge
+workers 2
+`
+	if buf.String() != expected {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), expected)
+	}
+}
+
+func TestRouterMetrics(t *testing.T) {
+	registry := NewMetricsRegistry()
+	router, err := NewRouterBuilder().
+		Use(registry.RouterMetrics()).
+		Get("/users/:id", func(w http.ResponseWriter, req *http.Request) {
+			Response(w).WithBody("user").AsTextPlain()
+		}).
+		Get("/metrics", registry.Handler()).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/1", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/2", nil))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	want := `http_server_requests_total{method="GET",route="/users/:id",status="2xx"} 2`
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("missing %q in:\n%s", want, rec.Body.String())
+	}
+}
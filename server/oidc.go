@@ -0,0 +1,373 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"github.com/enolgor/go-utils-mm/cryp"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type OIDCOptions struct {
+	// Issuer is the provider URL, its configuration is discovered from
+	// /.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the absolute URL CallbackHandler is mounted at, as
+	// registered with the provider.
+	RedirectURL string
+	// Scopes default to openid, profile and email.
+	Scopes []string
+	// Principal maps the claims of the verified ID token to the principal our
+	// token is issued for, nil denying the login. Defaults to the sub claim.
+	Principal func(claims jwt.MapClaims) (*Principal, error)
+	// Key signs the cookie keeping the login state between redirects. A
+	// random key is used when empty, which only works with a single instance.
+	Key        []byte
+	CookieName string
+	// StateTTL bounds how long the user has to log in, defaults to 10 minutes.
+	StateTTL time.Duration
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type oidcState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Redirect string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+// OIDC logs users in with an OpenID Connect provider using the authorization
+// code flow with PKCE, then issues the token of auth as LoginHandler does.
+type OIDC struct {
+	auth        *JwtAuth
+	options     OIDCOptions
+	signer      cryp.Signer
+	mu          sync.Mutex
+	provider    *oidcProvider
+	keys        *RemoteKeySet
+	discovering chan struct{}
+	err         error
+}
+
+// NewOIDC configures the relying party, the provider is discovered on the
+// first login.
+func NewOIDC(auth *JwtAuth, options OIDCOptions) *OIDC {
+	options.Issuer = strings.TrimSuffix(options.Issuer, "/")
+	if options.Scopes == nil {
+		options.Scopes = []string{"openid", "profile", "email"}
+	}
+	if options.Principal == nil {
+		options.Principal = func(claims jwt.MapClaims) (*Principal, error) {
+			sub, err := claims.GetSubject()
+			if err != nil || sub == "" {
+				return nil, err
+			}
+			return &Principal{Subject: sub}, nil
+		}
+	}
+	if options.Key == nil {
+		options.Key = []byte(randomToken())
+	}
+	if options.CookieName == "" {
+		options.CookieName = "_oidc"
+	}
+	if auth.transport.HostPrefix && !strings.HasPrefix(options.CookieName, hostPrefix) {
+		options.CookieName = hostPrefix + options.CookieName
+	}
+	if options.StateTTL == 0 {
+		options.StateTTL = 10 * time.Minute
+	}
+	return &OIDC{auth: auth, options: options, signer: cryp.HMAC(options.Key)}
+}
+
+// fetchProvider reads the provider configuration, detached from the request
+// that triggered it so its cancellation doesn't fail the requests waiting.
+func (o *OIDC) fetchProvider(ctx context.Context) (*oidcProvider, error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	resp, err := client.Get(o.options.Issuer + "/.well-known/openid-configuration").WithContext(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: status %d", resp.StatusCode)
+	}
+	var provider oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != o.options.Issuer {
+		return nil, fmt.Errorf("discovery: issuer %q doesn't match %q", provider.Issuer, o.options.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JwksURI == "" {
+		return nil, fmt.Errorf("discovery: missing endpoints")
+	}
+	return &provider, nil
+}
+
+// discover returns the provider, fetching it once without holding the lock,
+// concurrent callers wait for the same fetch or for their ctx.
+func (o *OIDC) discover(ctx context.Context) (*oidcProvider, *RemoteKeySet, error) {
+	o.mu.Lock()
+	if o.provider != nil {
+		defer o.mu.Unlock()
+		return o.provider, o.keys, nil
+	}
+	if o.discovering == nil {
+		done := make(chan struct{})
+		o.discovering = done
+		go func() {
+			provider, err := o.fetchProvider(ctx)
+			o.mu.Lock()
+			if err == nil {
+				o.provider, o.keys = provider, NewRemoteKeySet(provider.JwksURI, time.Hour, 10*time.Second)
+			}
+			o.err = err
+			o.discovering = nil
+			o.mu.Unlock()
+			close(done)
+		}()
+	}
+	done := o.discovering
+	o.mu.Unlock()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider == nil {
+		return nil, nil, o.err
+	}
+	return o.provider, o.keys, nil
+}
+
+// localRedirect only allows paths of this site, so the login can't be used as
+// an open redirect.
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+// LoginHandler redirects to the provider, returning to the redirect query
+// parameter once logged in.
+func (o *OIDC) LoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		provider, _, err := o.discover(req.Context())
+		if err != nil {
+			Logger(req).Error("discovering oidc provider", "error", err)
+			Response(w).Status(http.StatusBadGateway).WithBody(Localize(req, "identity provider unavailable")).AsTextPlain()
+			return
+		}
+		expires := o.auth.validation.Now().Add(o.options.StateTTL)
+		state := oidcState{
+			State:    randomToken(),
+			Nonce:    randomToken(),
+			Verifier: randomToken(),
+			Redirect: localRedirect(req.URL.Query().Get("redirect")),
+			Expires:  expires.Unix(),
+		}
+		data, err := json.Marshal(state)
+		if err != nil {
+			panic(err)
+		}
+		// the provider redirects back cross-site, strict cookies wouldn't be sent
+		cookie := o.auth.cookie(o.options.CookieName, o.signer.Sign(data), expires)
+		cookie.SameSite = http.SameSiteLaxMode
+		http.SetCookie(w, cookie)
+
+		challenge := sha256.Sum256([]byte(state.Verifier))
+		target, err := url.Parse(provider.AuthorizationEndpoint)
+		if err != nil {
+			Response(w).Status(http.StatusBadGateway).WithBody(Localize(req, "identity provider unavailable")).AsTextPlain()
+			return
+		}
+		query := target.Query()
+		query.Set("response_type", "code")
+		query.Set("client_id", o.options.ClientID)
+		query.Set("redirect_uri", o.options.RedirectURL)
+		query.Set("scope", strings.Join(o.options.Scopes, " "))
+		query.Set("state", state.State)
+		query.Set("nonce", state.Nonce)
+		query.Set("code_challenge", b64.EncodeToString(challenge[:]))
+		query.Set("code_challenge_method", "S256")
+		target.RawQuery = query.Encode()
+		http.Redirect(w, req, target.String(), http.StatusFound)
+	}
+}
+
+func (o *OIDC) state(req *http.Request) (*oidcState, error) {
+	cook, err := req.Cookie(o.options.CookieName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := o.signer.Verify(cook.Value)
+	if err != nil {
+		return nil, err
+	}
+	var state oidcState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if o.auth.validation.Now().Unix() > state.Expires {
+		return nil, errors.New("login state expired")
+	}
+	submitted := req.URL.Query().Get("state")
+	if submitted == "" || subtle.ConstantTimeCompare([]byte(submitted), []byte(state.State)) != 1 {
+		return nil, errors.New("login state mismatch")
+	}
+	return &state, nil
+}
+
+// CallbackHandler completes the login: it exchanges the code for an ID token,
+// verifies it with the keys published by the provider and issues our token.
+func (o *OIDC) CallbackHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		fail := func(status int, message string) {
+			Response(w).Status(status).WithBody(Localize(req, message)).AsTextPlain()
+		}
+		state, err := o.state(req)
+		cleared := o.auth.cookie(o.options.CookieName, "", time.Time{})
+		cleared.MaxAge = -1
+		http.SetCookie(w, cleared)
+		if err != nil {
+			Logger(req).Info("rejected oidc callback", "error", err)
+			fail(http.StatusBadRequest, "invalid login state")
+			return
+		}
+		query := req.URL.Query()
+		if reason := query.Get("error"); reason != "" {
+			Logger(req).Info("oidc login failed", "error", reason, "description", query.Get("error_description"))
+			fail(http.StatusUnauthorized, "login failed")
+			return
+		}
+		code := query.Get("code")
+		if code == "" {
+			fail(http.StatusBadRequest, "invalid login state")
+			return
+		}
+		provider, keys, err := o.discover(req.Context())
+		if err != nil {
+			Logger(req).Error("discovering oidc provider", "error", err)
+			fail(http.StatusBadGateway, "identity provider unavailable")
+			return
+		}
+		idToken, err := o.exchange(req.Context(), provider, code, state.Verifier)
+		if err != nil {
+			Logger(req).Error("exchanging oidc code", "error", err)
+			fail(http.StatusUnauthorized, "login failed")
+			return
+		}
+		claims, err := o.verify(idToken, provider, keys, state.Nonce)
+		if err != nil {
+			Logger(req).Warn("rejected id token", "error", err)
+			fail(http.StatusUnauthorized, "login failed")
+			return
+		}
+		principal, err := o.options.Principal(claims)
+		if err != nil {
+			Logger(req).Error("mapping oidc principal", "error", err)
+			fail(http.StatusInternalServerError, "internal server error")
+			return
+		} else if principal == nil {
+			fail(http.StatusForbidden, "forbidden")
+			return
+		}
+		if err := o.auth.issue(w, principal, ""); err != nil {
+			Logger(req).Error("issuing token", "error", err)
+			fail(http.StatusInternalServerError, "internal server error")
+			return
+		}
+		Response(w).Redirect(state.Redirect)
+	}
+}
+
+func (o *OIDC) exchange(ctx context.Context, provider *oidcProvider, code, verifier string) (string, error) {
+	r := client.Post(provider.TokenEndpoint).
+		WithContext(ctx).
+		WithHeader(client.Accept, "application/json").
+		WithFormValue("grant_type", "authorization_code").
+		WithFormValue("code", code).
+		WithFormValue("redirect_uri", o.options.RedirectURL).
+		WithFormValue("client_id", o.options.ClientID).
+		WithFormValue("code_verifier", verifier)
+	if o.options.ClientSecret != "" {
+		credentials := url.QueryEscape(o.options.ClientID) + ":" + url.QueryEscape(o.options.ClientSecret)
+		r.WithHeader(client.Authorization, "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	resp, err := r.Do()
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: status %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint: status %d: %s %s", resp.StatusCode, body.Error, body.Description)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint: no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// verify checks the ID token as required by OpenID Connect Core 3.1.3.7.
+// Only tokens signed with the provider keys are accepted, not with the
+// client secret, and iss must match the discovered issuer exactly.
+func (o *OIDC) verify(idToken string, provider *oidcProvider, keys *RemoteKeySet, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, keys.Keyfunc,
+		jwt.WithValidMethods(asymmetricMethods),
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(o.options.ClientID),
+		jwt.WithLeeway(o.auth.validation.Leeway),
+		jwt.WithTimeFunc(o.auth.validation.Now),
+		jwt.WithIssuedAt(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("%w exp", jwt.ErrTokenRequiredClaimMissing)
+	}
+	if n, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(n), []byte(nonce)) != 1 {
+		return nil, errors.New("id token nonce mismatch")
+	}
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != o.options.ClientID {
+			return nil, errors.New("id token authorized party mismatch")
+		}
+	}
+	return claims, nil
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type stubIdP struct {
+	*httptest.Server
+	keys        *KeySet
+	mu          sync.Mutex
+	codes       map[string]url.Values
+	tamperNonce bool
+	// issuerPath is appended to the server URL to form the issuer, and
+	// tokenIssuer overrides the iss claim of the id tokens.
+	issuerPath  string
+	tokenIssuer string
+}
+
+func (idp *stubIdP) issuer() string {
+	return idp.URL + idp.issuerPath
+}
+
+func newStubIdP(t *testing.T, clientID, secret string) *stubIdP {
+	key, err := GenerateSigningKey("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &stubIdP{keys: NewKeySet(key, time.Hour), codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		Response(w).WithBody(map[string]string{
+			"issuer":                 idp.issuer(),
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		}).AsJson()
+	})
+	mux.HandleFunc("/jwks", idp.keys.Handler())
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		if query.Get("client_id") != clientID || query.Get("code_challenge_method") != "S256" || query.Get("response_type") != "code" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		code := randomToken()
+		idp.mu.Lock()
+		idp.codes[code] = query
+		idp.mu.Unlock()
+		callback, _ := url.Parse(query.Get("redirect_uri"))
+		callback.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+		http.Redirect(w, req, callback.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		user, pass, _ := req.BasicAuth()
+		idp.mu.Lock()
+		auth, ok := idp.codes[req.PostFormValue("code")]
+		delete(idp.codes, req.PostFormValue("code"))
+		idp.mu.Unlock()
+		challenge := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+		if user != clientID || pass != secret || !ok ||
+			auth.Get("code_challenge") != b64.EncodeToString(challenge[:]) ||
+			auth.Get("redirect_uri") != req.PostFormValue("redirect_uri") {
+			Response(w).Status(http.StatusBadRequest).WithBody(map[string]string{"error": "invalid_grant"}).AsJson()
+			return
+		}
+		nonce, iss := auth.Get("nonce"), idp.issuer()
+		if idp.tokenIssuer != "" {
+			iss = idp.tokenIssuer
+		}
+		if idp.tamperNonce {
+			nonce = "tampered"
+		}
+		signing := idp.keys.Current()
+		tkn := jwt.NewWithClaims(signing.Method, jwt.MapClaims{
+			"iss":   iss,
+			"sub":   "alice",
+			"aud":   clientID,
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": nonce,
+			"email": "alice@example.com",
+		})
+		tkn.Header["kid"] = signing.ID
+		idToken, err := tkn.SignedString(signing.Private)
+		if err != nil {
+			t.Error(err)
+		}
+		Response(w).WithBody(map[string]string{"id_token": idToken, "access_token": "opaque", "token_type": "Bearer"}).AsJson()
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func TestOIDC(t *testing.T) {
+	idp := newStubIdP(t, "app", "s3cret")
+	defer idp.Close()
+	ja := NewJwtAuth([]byte("secret"), time.Hour, nil)
+	oidc := NewOIDC(ja, OIDCOptions{
+		Issuer:       idp.URL,
+		ClientID:     "app",
+		ClientSecret: "s3cret",
+		RedirectURL:  "https://app.example.com/callback",
+		Principal: func(claims jwt.MapClaims) (*Principal, error) {
+			email, _ := claims["email"].(string)
+			if !strings.HasSuffix(email, "@example.com") {
+				return nil, nil
+			}
+			return &Principal{Subject: email, Roles: []string{"staff"}}, nil
+		},
+	})
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	// login returns the state cookie and the callback url the provider
+	// redirects to.
+	login := func() (*http.Cookie, *url.URL) {
+		rec := httptest.NewRecorder()
+		oidc.LoginHandler()(rec, httptest.NewRequest(http.MethodGet, "/login?redirect=/orders", nil))
+		if rec.Code != http.StatusFound {
+			t.Fatalf("expected redirect to the provider, got %d %s", rec.Code, rec.Body)
+		}
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].SameSite != http.SameSiteLaxMode {
+			t.Fatalf("expected a lax state cookie, got %v", cookies)
+		}
+		resp, err := browser.Get(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		callback, err := resp.Location()
+		if err != nil {
+			t.Fatalf("expected redirect to the callback, got %d", resp.StatusCode)
+		}
+		return cookies[0], callback
+	}
+	callback := func(state *http.Cookie, target *url.URL) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target.String(), nil)
+		if state != nil {
+			req.AddCookie(state)
+		}
+		rec := httptest.NewRecorder()
+		oidc.CallbackHandler()(rec, req)
+		return rec
+	}
+
+	state, target := login()
+	rec := callback(state, target)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"/orders"`) {
+		t.Fatalf("expected login to complete, got %d %s", rec.Code, rec.Body)
+	}
+	var token *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == jwtCookieName {
+			token = c
+		}
+	}
+	if token == nil {
+		t.Fatal("expected a session token")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	req.AddCookie(token)
+	if !ja.StrictAuthHandler("/login")(httptest.NewRecorder(), req) || !RequireRole("staff")(httptest.NewRecorder(), req) {
+		t.Fatal("expected the session token to authorize the provider principal")
+	}
+	if sub, _ := JwtClaims(req).GetSubject(); sub != "alice@example.com" {
+		t.Fatalf("expected subject from the id token, got %q", sub)
+	}
+
+	if rec := callback(state, target); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected replayed code to be rejected, got %d", rec.Code)
+	}
+	if rec := callback(nil, target); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected callback without state cookie to be rejected, got %d", rec.Code)
+	}
+	state, target = login()
+	forged := *target
+	query := forged.Query()
+	query.Set("state", "forged")
+	forged.RawQuery = query.Encode()
+	if rec := callback(state, &forged); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected state mismatch to be rejected, got %d", rec.Code)
+	}
+	idp.tamperNonce = true
+	state, target = login()
+	if rec := callback(state, target); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected nonce mismatch to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestOIDCIssuer(t *testing.T) {
+	idp := newStubIdP(t, "app", "s3cret")
+	defer idp.Close()
+	idp.issuerPath = "/"
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	login := func(issuer string) int {
+		oidc := NewOIDC(NewJwtAuth([]byte("secret"), time.Hour, nil), OIDCOptions{
+			Issuer:       issuer,
+			ClientID:     "app",
+			ClientSecret: "s3cret",
+			RedirectURL:  "https://app.example.com/callback",
+		})
+		rec := httptest.NewRecorder()
+		oidc.LoginHandler()(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+		resp, err := browser.Get(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		callback, err := resp.Location()
+		if err != nil {
+			t.Fatalf("expected redirect to the callback, got %d", resp.StatusCode)
+		}
+		req := httptest.NewRequest(http.MethodGet, callback.String(), nil)
+		req.AddCookie(rec.Result().Cookies()[0])
+		rec = httptest.NewRecorder()
+		oidc.CallbackHandler()(rec, req)
+		return rec.Code
+	}
+
+	if status := login(idp.URL + "/"); status != http.StatusOK {
+		t.Errorf("expected an issuer with a trailing slash to be verified, got %d", status)
+	}
+	if status := login(idp.URL); status != http.StatusOK {
+		t.Errorf("expected the configured issuer to match the discovered one, got %d", status)
+	}
+	idp.tokenIssuer = idp.URL
+	if status := login(idp.URL + "/"); status != http.StatusUnauthorized {
+		t.Errorf("expected an id token from another issuer to be rejected, got %d", status)
+	}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	var fetches atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	var provider *httptest.Server
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if fetches.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		Response(w).WithBody(map[string]string{
+			"issuer":                 provider.URL,
+			"authorization_endpoint": provider.URL + "/authorize",
+			"token_endpoint":         provider.URL + "/token",
+			"jwks_uri":               provider.URL + "/jwks",
+		}).AsJson()
+	}))
+	defer provider.Close()
+	oidc := NewOIDC(NewJwtAuth([]byte("secret"), time.Hour, nil), OIDCOptions{Issuer: provider.URL})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := make(chan error)
+	go func() {
+		_, _, err := oidc.discover(ctx)
+		abandoned <- err
+	}()
+	<-started
+	waiting := make(chan error)
+	go func() {
+		_, _, err := oidc.discover(context.Background())
+		waiting <- err
+	}()
+	cancel()
+	if err := <-abandoned; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancelled caller to stop waiting, got %v", err)
+	}
+	close(release)
+	if err := <-waiting; err != nil {
+		t.Fatalf("expected the discovery to outlive the cancelled caller, got %v", err)
+	}
+	if discovered, keys, err := oidc.discover(context.Background()); err != nil || discovered.TokenEndpoint != provider.URL+"/token" || keys == nil {
+		t.Errorf("expected the provider to be kept, got %v %v", discovered, err)
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected a single fetch, got %d", fetches.Load())
+	}
+}
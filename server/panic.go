@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+type Panic struct {
+	Value any
+	Stack []byte
+}
+
+func (p *Panic) Error() string {
+	return fmt.Sprint(p.Value)
+}
+
+type PanicReporter func(req *http.Request, p *Panic)
+
+func LogPanicReporter(logger *slog.Logger) PanicReporter {
+	return func(req *http.Request, p *Panic) {
+		l := logger
+		if l == nil {
+			l = Logger(req)
+		}
+		l.Error("panic recovered",
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.String("route", RouteExpr(req)),
+			slog.String("panic", p.Error()),
+			slog.String("stack", string(p.Stack)),
+		)
+	}
+}
+
+func FilePanicReporter(path string) PanicReporter {
+	var mu sync.Mutex
+	return func(req *http.Request, p *Panic) {
+		mu.Lock()
+		defer mu.Unlock()
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			Logger(req).Error("opening panic report file", "error", err)
+			return
+		}
+		_, err = fmt.Fprintf(f, "%s %s %s: %s\n%s\n", time.Now().Format(time.RFC3339), req.Method, req.URL.Path, p.Error(), p.Stack)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			Logger(req).Error("writing panic report", "error", err)
+		}
+	}
+}
+
+const (
+	webhookQueueSize = 64
+	webhookTimeout   = 5 * time.Second
+)
+
+type webhookReport struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Route     string    `json:"route"`
+	RequestID string    `json:"request_id,omitempty"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+}
+
+// WebhookPanicReporter posts a JSON description of every panic to url. Posts
+// are queued to a single background worker so the error response isn't
+// delayed, each bound by a timeout. Reports are dropped while the queue is
+// full.
+func WebhookPanicReporter(url string) PanicReporter {
+	queue := make(chan webhookReport, webhookQueueSize)
+	var once sync.Once
+	worker := func() {
+		for body := range queue {
+			ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+			resp, err := client.Post(url).WithContext(ctx).WithHeader(client.ContentType, "application/json").WithBody(body).Do()
+			if err != nil {
+				slog.Error("posting panic report", "error", err, "request_id", body.RequestID)
+			} else {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			cancel()
+		}
+	}
+	return func(req *http.Request, p *Panic) {
+		once.Do(func() { go worker() })
+		select {
+		case queue <- webhookReport{time.Now(), req.Method, req.URL.Path, RouteExpr(req), RequestID(req), p.Error(), string(p.Stack)}:
+		default:
+			Logger(req).Warn("panic report queue full, dropping report")
+		}
+	}
+}
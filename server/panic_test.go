@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPanicRecovery(t *testing.T) {
+	var reported []*Panic
+	var recovered any
+	var stack []byte
+	build := func(builder *RouterBuilder) *Router {
+		router, err := builder.
+			PanicReporters(func(req *http.Request, p *Panic) { reported = append(reported, p) }).
+			Get("/boom", func(w http.ResponseWriter, req *http.Request) {
+				panic("boom")
+			}).
+			Get("/partial", func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte("partial"))
+				panic("late")
+			}).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return router
+	}
+
+	rec := httptest.NewRecorder()
+	build(NewRouterBuilder()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/boom", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "boom") {
+		t.Errorf("expected the panic value in the development response, got %d %s", rec.Code, rec.Body)
+	}
+	if len(reported) != 1 || reported[0].Value != "boom" || !strings.Contains(string(reported[0].Stack), "panic_test.go") {
+		t.Fatalf("expected the reporter to receive the value and stack, got %v", reported)
+	}
+
+	rec = httptest.NewRecorder()
+	custom := NewRouterBuilder().Production().InternalErr(func(w http.ResponseWriter, req *http.Request) {
+		recovered = Recover(req)
+		if p := RecoverPanic(req); p != nil {
+			stack = p.Stack
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	build(custom).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/boom", nil))
+	if recovered != "boom" || !strings.Contains(string(stack), "panic_test.go") {
+		t.Errorf("expected the panic value and stack for the handler, got %v %s", recovered, stack)
+	}
+
+	reported = nil
+	rec = httptest.NewRecorder()
+	failing := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			panic("middleware")
+		})
+	}
+	build(NewRouterBuilder().Use(failing)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/boom", nil))
+	if rec.Code != http.StatusInternalServerError || len(reported) != 1 || reported[0].Value != "middleware" {
+		t.Errorf("expected a middleware panic to be reported and answered, got %d %v", rec.Code, reported)
+	}
+
+	rec = httptest.NewRecorder()
+	build(NewRouterBuilder().Production()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/boom", nil))
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "boom") {
+		t.Errorf("expected the panic value hidden in production, got %d %s", rec.Code, rec.Body)
+	}
+
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("expected a partial response to abort the connection, got %v", rec)
+		}
+	}()
+	build(NewRouterBuilder()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/partial", nil))
+}
+
+func TestFilePanicReporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "panics.log")
+	req := httptest.NewRequest(http.MethodGet, "/boom", nil)
+	FilePanicReporter(path)(req, &Panic{Value: "boom", Stack: []byte("stack")})
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "GET /boom: boom\nstack") {
+		t.Errorf("unexpected report %q", content)
+	}
+
+	var out bytes.Buffer
+	handler := AccessLog(LogOptions{Logger: slog.New(slog.NewTextHandler(&out, nil))})(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		FilePanicReporter(filepath.Join(path, "missing", "panics.log"))(req, &Panic{Value: "boom"})
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.Contains(out.String(), "panic report file") {
+		t.Errorf("expected the write error to be logged, got %q", out.String())
+	}
+}
+
+func TestWebhookPanicReporter(t *testing.T) {
+	received := make(chan webhookReport, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var report webhookReport
+		json.NewDecoder(req.Body).Decode(&report)
+		received <- report
+	}))
+	defer hook.Close()
+	report := WebhookPanicReporter(hook.URL)
+	report(httptest.NewRequest(http.MethodGet, "/boom", nil), &Panic{Value: errors.New("boom"), Stack: []byte("stack")})
+	select {
+	case r := <-received:
+		if r.Method != http.MethodGet || r.Path != "/boom" || r.Panic != "boom" || r.Stack != "stack" {
+			t.Errorf("unexpected report %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the report to be posted")
+	}
+}
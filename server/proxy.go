@@ -0,0 +1,381 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+type Balancing int
+
+const (
+	RoundRobin Balancing = iota
+	LeastConnections
+	ConsistentHash
+)
+
+type ProxyOptions struct {
+	Balancing Balancing
+	// HashKey selects the value hashed by ConsistentHash, defaults to the
+	// client IP.
+	HashKey func(*http.Request) string
+	// Rewrite is the upstream path, ":name" and ":0" are replaced by the
+	// path escaped route path params, requests with a "." or ".." param
+	// segment are rejected. The request path is forwarded unchanged when
+	// empty.
+	Rewrite string
+	// Retries is the number of other backends tried when an idempotent
+	// request fails to reach its backend.
+	Retries      int
+	MaxRetryBody int64
+	// HealthPath enables active health checks every HealthInterval, only
+	// healthy backends receive traffic.
+	HealthPath     string
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	// Context stops the health checks when done, it is required with
+	// HealthPath.
+	Context context.Context
+	// TrustForwarded keeps the X-Forwarded-For chain sent by the client,
+	// enable it only behind trusted proxies.
+	TrustForwarded bool
+	Transport      http.RoundTripper
+}
+
+type backend struct {
+	url     *url.URL
+	active  atomic.Int64
+	healthy atomic.Bool
+}
+
+type ringNode struct {
+	hash    uint32
+	backend *backend
+}
+
+type balancer struct {
+	backends []*backend
+	mode     Balancing
+	hashKey  func(*http.Request) string
+	next     atomic.Uint64
+	ring     []ringNode
+}
+
+func newBalancer(backends []*backend, options ProxyOptions) *balancer {
+	b := &balancer{backends: backends, mode: options.Balancing, hashKey: options.HashKey}
+	if b.hashKey == nil {
+		b.hashKey = KeyByIP
+	}
+	if b.mode == ConsistentHash {
+		for _, be := range backends {
+			for i := 0; i < 100; i++ {
+				b.ring = append(b.ring, ringNode{hash32(fmt.Sprintf("%s#%d", be.url, i)), be})
+			}
+		}
+		sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	}
+	return b
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func (b *balancer) available(be *backend, tried map[*backend]bool) bool {
+	return be.healthy.Load() && !tried[be]
+}
+
+func (b *balancer) pick(req *http.Request, tried map[*backend]bool) *backend {
+	switch b.mode {
+	case LeastConnections:
+		var best *backend
+		for _, be := range b.backends {
+			if b.available(be, tried) && (best == nil || be.active.Load() < best.active.Load()) {
+				best = be
+			}
+		}
+		return best
+	case ConsistentHash:
+		h := hash32(b.hashKey(req))
+		start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+		for i := 0; i < len(b.ring); i++ {
+			node := b.ring[(start+i)%len(b.ring)]
+			if b.available(node.backend, tried) {
+				return node.backend
+			}
+		}
+		return nil
+	default:
+		n := uint64(len(b.backends))
+		start := b.next.Add(1)
+		for i := uint64(0); i < n; i++ {
+			be := b.backends[(start+i)%n]
+			if b.available(be, tried) {
+				return be
+			}
+		}
+		return nil
+	}
+}
+
+type proxyContextKey int
+
+const (
+	proxyBodyKey proxyContextKey = iota
+	proxyPathKey
+)
+
+var (
+	errNoBackend   = errors.New("no healthy backend available")
+	errInvalidPath = errors.New("invalid path segment")
+)
+
+type proxyTransport struct {
+	balancer  *balancer
+	transport http.RoundTripper
+	retries   int
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func (pt *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	retryable := isIdempotent(req.Method) && req.Header.Get(client.Upgrade) == ""
+	if v := req.Context().Value(contextKey(proxyBodyKey)); v != nil {
+		body = v.([]byte)
+	} else if req.Body != nil && req.Body != http.NoBody {
+		retryable = false
+	}
+	tried := map[*backend]bool{}
+	var lastErr error = errNoBackend
+	for attempt := 0; attempt <= pt.retries; attempt++ {
+		be := pt.balancer.pick(req, tried)
+		if be == nil {
+			break
+		}
+		tried[be] = true
+		out := req.Clone(req.Context())
+		out.URL.Scheme = be.url.Scheme
+		out.URL.Host = be.url.Host
+		out.URL.Path, out.URL.RawPath = joinURLPath(be.url, out.URL)
+		out.Host = ""
+		if body != nil {
+			out.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		be.active.Add(1)
+		resp, err := pt.transport.RoundTrip(out)
+		if err != nil {
+			be.active.Add(-1)
+			lastErr = err
+			if !retryable || req.Context().Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		resp.Body = trackBody(resp.Body, be)
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+func joinURLPath(base, u *url.URL) (string, string) {
+	if base.Path == "" || base.Path == "/" {
+		return u.Path, u.RawPath
+	}
+	joined := strings.TrimSuffix(base.Path, "/") + "/" + strings.TrimPrefix(u.Path, "/")
+	if u.RawPath == "" {
+		return joined, ""
+	}
+	return joined, strings.TrimSuffix(base.EscapedPath(), "/") + "/" + strings.TrimPrefix(u.RawPath, "/")
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	backend *backend
+	once    sync.Once
+}
+
+func (tb *trackedBody) Close() error {
+	tb.once.Do(func() { tb.backend.active.Add(-1) })
+	return tb.ReadCloser.Close()
+}
+
+// trackedConn keeps upgraded connections writable, as required by the
+// reverse proxy to tunnel websockets.
+type trackedConn struct {
+	*trackedBody
+	w io.Writer
+}
+
+func (tc *trackedConn) Write(p []byte) (int, error) {
+	return tc.w.Write(p)
+}
+
+func trackBody(body io.ReadCloser, be *backend) io.ReadCloser {
+	tracked := &trackedBody{ReadCloser: body, backend: be}
+	if w, ok := body.(io.Writer); ok {
+		return &trackedConn{tracked, w}
+	}
+	return tracked
+}
+
+// rewritePath returns the escaped upstream path, each segment of the params
+// is escaped so they can't add query strings or fragments, and dot segments
+// are rejected so they can't climb out of the template.
+func rewritePath(tmpl string, params map[any]string) (string, error) {
+	keys := make([]string, 0, len(params))
+	values := map[string]string{}
+	for k, v := range params {
+		key := fmt.Sprint(k)
+		segments := strings.Split(v, "/")
+		for i, segment := range segments {
+			if segment == "." || segment == ".." {
+				return "", errInvalidPath
+			}
+			segments[i] = url.PathEscape(segment)
+		}
+		keys = append(keys, key)
+		values[key] = strings.Join(segments, "/")
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	for _, key := range keys {
+		tmpl = strings.ReplaceAll(tmpl, ":"+key, values[key])
+	}
+	return tmpl, nil
+}
+
+func (b *balancer) healthCheck(ctx context.Context, path string, interval, timeout time.Duration) {
+	check := func() {
+		for _, be := range b.backends {
+			target := be.url.JoinPath(path).String()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			err := UpstreamCheck(target)(checkCtx)
+			cancel()
+			be.healthy.Store(err == nil)
+		}
+	}
+	check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
+
+// Proxy forwards requests to targets, balancing between them. It panics if a
+// target is not a valid absolute URL, or if HealthPath is set without a
+// Context to stop the health checks.
+func Proxy(targets []string, options ProxyOptions) http.HandlerFunc {
+	backends := make([]*backend, len(targets))
+	for i, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			panic(fmt.Sprintf("invalid proxy target %q", target))
+		}
+		backends[i] = &backend{url: u}
+		backends[i].healthy.Store(true)
+	}
+	if options.Transport == nil {
+		options.Transport = http.DefaultTransport
+	}
+	if options.MaxRetryBody == 0 {
+		options.MaxRetryBody = 1 << 20
+	}
+	if options.HealthTimeout == 0 {
+		options.HealthTimeout = 2 * time.Second
+	}
+	bal := newBalancer(backends, options)
+	if options.HealthPath != "" {
+		if options.Context == nil {
+			panic("proxy health checks require a Context")
+		}
+		if options.HealthInterval == 0 {
+			options.HealthInterval = 10 * time.Second
+		}
+		go bal.healthCheck(options.Context, options.HealthPath, options.HealthInterval, options.HealthTimeout)
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			if options.TrustForwarded {
+				pr.Out.Header[client.XForwardedFor] = pr.In.Header[client.XForwardedFor]
+			}
+			pr.SetXForwarded()
+			// SetXForwarded only looks at TLS, the scheme resolved by
+			// TrustProxies is the one the client used
+			if pr.In.URL.Scheme != "" {
+				pr.Out.Header.Set(client.XForwardedProto, pr.In.URL.Scheme)
+			}
+			var rewritten string
+			if GetContextValue(pr.In, proxyPathKey, &rewritten) {
+				pr.Out.URL.Path, _ = url.PathUnescape(rewritten)
+				pr.Out.URL.RawPath = rewritten
+			}
+		},
+		Transport: &proxyTransport{balancer: bal, transport: options.Transport, retries: options.Retries},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			status := http.StatusBadGateway
+			if errors.Is(err, errNoBackend) {
+				status = http.StatusServiceUnavailable
+			} else if errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusGatewayTimeout
+			}
+			Response(w).Status(status).WithBody(Localize(req, http.StatusText(status))).AsTextPlain()
+		},
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if options.Rewrite != "" {
+			rewritten, err := rewritePath(options.Rewrite, PathParams(req))
+			if err != nil {
+				Response(w).Status(http.StatusBadRequest).WithBody(Localize(req, "invalid path")).AsTextPlain()
+				return
+			}
+			AddContextValue(req, proxyPathKey, rewritten)
+		}
+		if options.Retries > 0 && isIdempotent(req.Method) && req.Body != nil && req.Body != http.NoBody {
+			body, err := io.ReadAll(io.LimitReader(req.Body, options.MaxRetryBody+1))
+			if err != nil {
+				req.Body.Close()
+				Response(w).Status(http.StatusBadRequest).WithBody(Localize(req, "error reading body")).AsTextPlain()
+				return
+			}
+			if int64(len(body)) <= options.MaxRetryBody {
+				req.Body.Close()
+				AddContextValue(req, proxyBodyKey, body)
+				req.Body = io.NopCloser(bytes.NewReader(body))
+			} else {
+				// too large to retry, the rest is streamed from the client
+				req.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			}
+		}
+		rp.ServeHTTP(w, req)
+	}
+}
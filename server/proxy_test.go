@@ -0,0 +1,191 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+func TestProxy(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := io.ReadAll(req.Body)
+			w.Header().Set("X-Backend", name)
+			w.Header().Set("X-Path", req.URL.Path)
+			w.Header().Set("X-Seen-For", req.Header.Get(client.XForwardedFor))
+			w.Header().Set("X-Seen-Proto", req.Header.Get(client.XForwardedProto))
+			w.Write(body)
+		}))
+	}
+	a, b := upstream("a"), upstream("b")
+	defer a.Close()
+	defer b.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	router, err := NewRouterBuilder().
+		Put("/api/:id", Proxy([]string{a.URL, down.URL, b.URL}, ProxyOptions{Rewrite: "/v1/items/:id", Retries: 1})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		req := httptest.NewRequest(http.MethodPut, "/api/42", strings.NewReader("payload"))
+		req.Header.Set(client.XForwardedFor, "10.0.0.1")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if body := rec.Body.String(); body != "payload" {
+			t.Fatalf("expected body to be replayed, got %q", body)
+		}
+		if path := rec.Header().Get("X-Path"); path != "/v1/items/42" {
+			t.Fatalf("expected rewritten path, got %q", path)
+		}
+		if xff := rec.Header().Get("X-Seen-For"); strings.Contains(xff, "10.0.0.1") {
+			t.Fatalf("untrusted forwarded chain was kept: %q", xff)
+		}
+		seen[rec.Header().Get("X-Backend")]++
+	}
+	if seen["a"] == 0 || seen["b"] == 0 {
+		t.Fatalf("expected traffic on both backends, got %v", seen)
+	}
+
+	large, err := NewRouterBuilder().
+		Put("/(.*)", Proxy([]string{a.URL}, ProxyOptions{Retries: 1, MaxRetryBody: 4})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/x", nil)
+	req.Body, req.ContentLength = &closableBody{Reader: strings.NewReader("payload")}, 7
+	large.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "payload" {
+		t.Fatalf("expected a body over MaxRetryBody to be streamed, got %d %q", rec.Code, rec.Body)
+	}
+
+	post, err := NewRouterBuilder().
+		Post("/(.*)", Proxy([]string{down.URL}, ProxyOptions{Retries: 3})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	behind, err := NewRouterBuilder().
+		Use(TrustProxies(TrustedProxyOptions{Proxies: []string{"192.0.2.0/24"}})).
+		Get("/(.*)", Proxy([]string{a.URL}, ProxyOptions{})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/x", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set(client.XForwardedFor, "203.0.113.9")
+	req.Header.Set(client.XForwardedProto, "https")
+	behind.ServeHTTP(rec, req)
+	if proto := rec.Header().Get("X-Seen-Proto"); proto != "https" {
+		t.Fatalf("expected the scheme resolved by TrustProxies to be forwarded, got %q", proto)
+	}
+
+	rec = httptest.NewRecorder()
+	post.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/x", strings.NewReader("x")))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	backends := []*backend{}
+	for _, target := range []string{"http://a", "http://b", "http://c"} {
+		u, _ := url.Parse(target)
+		be := &backend{url: u}
+		be.healthy.Store(true)
+		backends = append(backends, be)
+	}
+	bal := newBalancer(backends, ProxyOptions{Balancing: ConsistentHash, HashKey: func(req *http.Request) string {
+		return req.Header.Get("X-User")
+	}})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-User", "alice")
+	first := bal.pick(req, nil)
+	for i := 0; i < 10; i++ {
+		if bal.pick(req, nil) != first {
+			t.Fatal("expected the same backend for the same key")
+		}
+	}
+	first.healthy.Store(false)
+	if next := bal.pick(req, nil); next == nil || next == first {
+		t.Fatal("expected failover to another backend")
+	}
+}
+
+func TestProxyRewrite(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Path", req.URL.EscapedPath())
+	}))
+	defer upstream.Close()
+	router, err := NewRouterBuilder().
+		Get("/files/(.*)", Proxy([]string{upstream.URL + "/base"}, ProxyOptions{Rewrite: "/static/:0"})).
+		Get("/items/:id", Proxy([]string{upstream.URL}, ProxyOptions{Rewrite: "/v1/items/:id/detail"})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type testCase struct {
+		path     string
+		status   int
+		upstream string
+	}
+	testCases := []testCase{
+		{"/files/css/site.css", http.StatusOK, "/base/static/css/site.css"},
+		{"/files/a%3Fb%23c", http.StatusOK, "/base/static/a%3Fb%23c"},
+		{"/files/../admin", http.StatusBadRequest, ""},
+		{"/files/css/%2E%2E/%2E%2E/admin", http.StatusBadRequest, ""},
+		{"/files/./site.css", http.StatusBadRequest, ""},
+		{"/items/%2E%2E", http.StatusBadRequest, ""},
+		{"/items/a%20b", http.StatusOK, "/v1/items/a%20b/detail"},
+	}
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.status || rec.Header().Get("X-Path") != tc.upstream {
+			t.Errorf("%s: expected %d %q, got %d %q", tc.path, tc.status, tc.upstream, rec.Code, rec.Header().Get("X-Path"))
+		}
+	}
+}
+
+func TestProxyHealthRequiresContext(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected health checks without a context to panic")
+		}
+	}()
+	Proxy([]string{"http://localhost"}, ProxyOptions{HealthPath: "/healthz"})
+}
+
+// closableBody fails reads once closed, like the body of a server request.
+type closableBody struct {
+	*strings.Reader
+	closed bool
+}
+
+func (b *closableBody) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errors.New("read on closed body")
+	}
+	return b.Reader.Read(p)
+}
+
+func (b *closableBody) Close() error {
+	b.closed = true
+	return nil
+}
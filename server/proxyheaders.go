@@ -0,0 +1,229 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+// PrivateNetworks are the loopback and private ranges, where proxies usually
+// live.
+var PrivateNetworks = []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7"}
+
+type TrustedProxyOptions struct {
+	// Proxies are the IPs or CIDRs of the proxies allowed to set forwarding
+	// headers.
+	Proxies []string
+	// Forwarded reads the RFC 7239 Forwarded header, preferred over the
+	// X-Forwarded-* headers when present.
+	Forwarded bool
+}
+
+type proxyHeadersContextKey int
+
+const clientIPKey proxyHeadersContextKey = iota
+
+// forwardedHop is one hop of the forwarding chain, a Forwarded element or an
+// X-Forwarded-For entry.
+type forwardedHop struct {
+	ip    net.IP
+	port  string
+	proto string
+	host  string
+}
+
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			panic(fmt.Sprintf("invalid trusted proxy %q", proxy))
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+func trusted(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitQuoted splits s on sep outside double quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = strings.ReplaceAll(s[1:len(s)-1], `\`, "")
+	}
+	return s
+}
+
+// parseNode parses a node of a forwarding header, an IP optionally with a
+// port and IPv6 addresses in brackets. The IP is nil for unknown and
+// obfuscated nodes.
+func parseNode(node string) (net.IP, string) {
+	if ip := net.ParseIP(node); ip != nil {
+		return ip, ""
+	}
+	if host, port, err := net.SplitHostPort(node); err == nil {
+		return net.ParseIP(host), port
+	}
+	return net.ParseIP(strings.Trim(node, "[]")), ""
+}
+
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			hop := forwardedHop{}
+			for _, pair := range splitQuoted(element, ';') {
+				name, value, _ := strings.Cut(pair, "=")
+				value = unquote(value)
+				switch strings.ToLower(strings.TrimSpace(name)) {
+				case "for":
+					hop.ip, hop.port = parseNode(value)
+				case "proto":
+					hop.proto = strings.ToLower(value)
+				case "host":
+					hop.host = value
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+func lastValue(header http.Header, key string) string {
+	values := header.Values(key)
+	if len(values) == 0 {
+		return ""
+	}
+	parts := strings.Split(values[len(values)-1], ",")
+	return strings.TrimSpace(parts[len(parts)-1])
+}
+
+func parseXForwardedFor(header http.Header) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range header.Values(client.XForwardedFor) {
+		for _, node := range strings.Split(value, ",") {
+			ip, port := parseNode(strings.TrimSpace(node))
+			hops = append(hops, forwardedHop{ip: ip, port: port})
+		}
+	}
+	if len(hops) == 0 {
+		if ip, port := parseNode(strings.TrimSpace(header.Get(client.XRealIP))); ip != nil {
+			hops = append(hops, forwardedHop{ip: ip, port: port})
+		}
+	}
+	return hops
+}
+
+// TrustProxies resolves the client address, scheme and host of requests sent
+// by the trusted proxies and rewrites RemoteAddr, URL.Scheme and Host with
+// them. The forwarding chain is walked from the right, skipping trusted
+// proxies, so entries made up by clients are never used. It panics if a proxy
+// is not a valid IP or CIDR.
+func TrustProxies(options TrustedProxyOptions) Middleware {
+	nets := parseTrustedProxies(options.Proxies)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			remote, _ := parseNode(req.RemoteAddr)
+			if remote == nil || !trusted(nets, remote) {
+				next.ServeHTTP(w, req)
+				return
+			}
+			var hops []forwardedHop
+			forwarded := options.Forwarded && req.Header.Get(client.Forwarded) != ""
+			if forwarded {
+				hops = parseForwarded(req.Header.Values(client.Forwarded))
+			} else {
+				hops = parseXForwardedFor(req.Header)
+			}
+			clientHop := -1
+			for i := len(hops) - 1; i >= 0; i-- {
+				if hops[i].ip == nil {
+					break
+				}
+				clientHop = i
+				if !trusted(nets, hops[i].ip) {
+					break
+				}
+			}
+			if clientHop < 0 {
+				next.ServeHTTP(w, req)
+				return
+			}
+			hop := hops[clientHop]
+			if !forwarded {
+				// proxies set X-Forwarded-Proto and X-Forwarded-Host for the
+				// whole request, the value closest to us is kept
+				hop.proto = strings.ToLower(lastValue(req.Header, client.XForwardedProto))
+				hop.host = lastValue(req.Header, client.XForwardedHost)
+			}
+			port := hop.port
+			if port == "" {
+				port = "0"
+			}
+			req.RemoteAddr = net.JoinHostPort(hop.ip.String(), port)
+			AddContextValue(req, clientIPKey, hop.ip.String())
+			if hop.proto == "http" || hop.proto == "https" {
+				req.URL.Scheme = hop.proto
+			}
+			if hop.host != "" {
+				req.Host = hop.host
+				req.URL.Host = hop.host
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// ClientIP returns the address of the client, as resolved by TrustProxies or
+// taken from the connection otherwise.
+func ClientIP(req *http.Request) string {
+	var ip string
+	if GetContextValue(req, clientIPKey, &ip) {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+func TestTrustProxies(t *testing.T) {
+	type result struct {
+		ip, scheme, host string
+	}
+	var got result
+	handler := Chain(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = result{ClientIP(req), req.URL.Scheme, req.Host}
+	}), TrustProxies(TrustedProxyOptions{Proxies: []string{"10.0.0.0/8", "192.0.2.7"}, Forwarded: true}))
+
+	type testCase struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    result
+	}
+	cases := []testCase{
+		{"untrusted remote", "203.0.113.9:1000", map[string]string{client.XForwardedFor: "1.1.1.1"}, result{"203.0.113.9", "", "example.com"}},
+		{"spoofed left entry", "10.0.0.2:1000", map[string]string{client.XForwardedFor: "1.1.1.1, 198.51.100.4, 10.0.0.3"}, result{"198.51.100.4", "", "example.com"}},
+		{"all trusted", "10.0.0.2:1000", map[string]string{client.XForwardedFor: "192.0.2.7, 10.1.1.1"}, result{"192.0.2.7", "", "example.com"}},
+		{"proto and host", "10.0.0.2:1000", map[string]string{client.XForwardedFor: "198.51.100.4", client.XForwardedProto: "https", client.XForwardedHost: "shop.example.org"}, result{"198.51.100.4", "https", "shop.example.org"}},
+		{"real ip", "10.0.0.2:1000", map[string]string{client.XRealIP: "198.51.100.5"}, result{"198.51.100.5", "", "example.com"}},
+		{"unknown node", "10.0.0.2:1000", map[string]string{client.XForwardedFor: "198.51.100.4, unknown, 10.0.0.3"}, result{"10.0.0.3", "", "example.com"}},
+		{"forwarded", "10.0.0.2:1000", map[string]string{
+			client.Forwarded:     `for=1.1.1.1;proto=http, for="[2001:db8:cafe::17]:4711";proto=https;host=api.example.org, for=10.0.0.3`,
+			client.XForwardedFor: "9.9.9.9",
+		}, result{"2001:db8:cafe::17", "https", "api.example.org"}},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = c.remote
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		got = result{}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if got != c.want {
+			t.Fatalf("%s: expected %+v, got %+v", c.name, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+// RateLimitState is the per key state kept by the limiters. Token buckets use
+// Value as the available tokens and Time as the last refill, sliding windows
+// use Value and Prev as the current and previous window counts and Time as
+// the start of the current window.
+type RateLimitState struct {
+	Value float64
+	Prev  float64
+	Time  time.Time
+}
+
+type RateLimitStore interface {
+	// Update atomically applies fn to the state stored under key, creating a
+	// zero state if missing, and keeps it for at least ttl.
+	Update(key string, ttl time.Duration, fn func(state *RateLimitState))
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Time
+	RetryAfter time.Duration
+}
+
+type RateLimiter interface {
+	Allow(key string) RateLimitResult
+}
+
+type tokenBucket struct {
+	store RateLimitStore
+	rate  float64
+	burst int
+	now   func() time.Time
+}
+
+// TokenBucket allows bursts of up to burst requests, refilled at rate tokens
+// every per.
+func TokenBucket(rate int, per time.Duration, burst int, store RateLimitStore) RateLimiter {
+	return &tokenBucket{store, float64(rate) / per.Seconds(), burst, time.Now}
+}
+
+func (tb *tokenBucket) Allow(key string) RateLimitResult {
+	now := tb.now()
+	burst := float64(tb.burst)
+	ttl := time.Duration(burst / tb.rate * float64(time.Second))
+	result := RateLimitResult{Limit: tb.burst}
+	tb.store.Update(key, ttl, func(state *RateLimitState) {
+		if state.Time.IsZero() {
+			state.Value = burst
+		} else {
+			state.Value = math.Min(burst, state.Value+now.Sub(state.Time).Seconds()*tb.rate)
+		}
+		state.Time = now
+		if state.Value >= 1 {
+			state.Value--
+			result.Allowed = true
+		} else {
+			result.RetryAfter = time.Duration((1 - state.Value) / tb.rate * float64(time.Second))
+		}
+		result.Remaining = int(state.Value)
+		result.Reset = now.Add(time.Duration((burst - state.Value) / tb.rate * float64(time.Second)))
+	})
+	return result
+}
+
+type slidingWindow struct {
+	store  RateLimitStore
+	limit  int
+	window time.Duration
+	now    func() time.Time
+}
+
+// SlidingWindow allows limit requests in any window, weighting the previous
+// fixed window by how much of it still overlaps.
+func SlidingWindow(limit int, window time.Duration, store RateLimitStore) RateLimiter {
+	return &slidingWindow{store, limit, window, time.Now}
+}
+
+func (sw *slidingWindow) Allow(key string) RateLimitResult {
+	now := sw.now()
+	start := now.Truncate(sw.window)
+	limit := float64(sw.limit)
+	result := RateLimitResult{Limit: sw.limit, Reset: start.Add(sw.window)}
+	sw.store.Update(key, 2*sw.window, func(state *RateLimitState) {
+		if !state.Time.Equal(start) {
+			if state.Time.Equal(start.Add(-sw.window)) {
+				state.Prev = state.Value
+			} else {
+				state.Prev = 0
+			}
+			state.Value = 0
+			state.Time = start
+		}
+		elapsed := now.Sub(start)
+		weight := 1 - elapsed.Seconds()/sw.window.Seconds()
+		estimate := state.Prev*weight + state.Value
+		if estimate+1 <= limit {
+			state.Value++
+			result.Allowed = true
+			result.Remaining = int(limit - math.Ceil(estimate+1))
+			return
+		}
+		if state.Value+1 > limit || state.Prev == 0 {
+			result.RetryAfter = start.Add(sw.window).Sub(now)
+			return
+		}
+		wait := time.Duration(sw.window.Seconds()*(1-(limit-1-state.Value)/state.Prev)*float64(time.Second)) - elapsed
+		result.RetryAfter = wait
+	})
+	return result
+}
+
+type rateLimitEntry struct {
+	state   RateLimitState
+	expires time.Time
+}
+
+type rateLimitShard struct {
+	mu        sync.Mutex
+	entries   map[string]*rateLimitEntry
+	lastSweep time.Time
+}
+
+type memoryRateLimitStore struct {
+	shards []*rateLimitShard
+	now    func() time.Time
+}
+
+func NewMemoryRateLimitStore(shards int) RateLimitStore {
+	if shards < 1 {
+		shards = 1
+	}
+	store := &memoryRateLimitStore{shards: make([]*rateLimitShard, shards), now: time.Now}
+	for i := range store.shards {
+		store.shards[i] = &rateLimitShard{entries: map[string]*rateLimitEntry{}}
+	}
+	return store
+}
+
+func (ms *memoryRateLimitStore) shard(key string) *rateLimitShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return ms.shards[h.Sum32()%uint32(len(ms.shards))]
+}
+
+func (ms *memoryRateLimitStore) Update(key string, ttl time.Duration, fn func(state *RateLimitState)) {
+	now := ms.now()
+	shard := ms.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if now.Sub(shard.lastSweep) > time.Minute {
+		for k, entry := range shard.entries {
+			if now.After(entry.expires) {
+				delete(shard.entries, k)
+			}
+		}
+		shard.lastSweep = now
+	}
+	entry, ok := shard.entries[key]
+	if !ok || now.After(entry.expires) {
+		entry = &rateLimitEntry{}
+		shard.entries[key] = entry
+	}
+	fn(&entry.state)
+	entry.expires = now.Add(ttl)
+}
+
+func KeyByIP(req *http.Request) string {
+	return ClientIP(req)
+}
+
+func KeyBySubject(req *http.Request) string {
+	if claims := JwtClaims(req); claims != nil {
+		if sub, err := claims.GetSubject(); err == nil && sub != "" {
+			return "sub:" + sub
+		}
+	}
+	return "ip:" + KeyByIP(req)
+}
+
+type RateLimitOptions struct {
+	Limiter RateLimiter
+	Key     func(*http.Request) string
+	// Scope is prefixed to every key so limiters sharing a store, for
+	// example one per route, don't share counters.
+	Scope        string
+	ErrorHandler http.HandlerFunc
+}
+
+var defaultRateLimitErr = func(w http.ResponseWriter, req *http.Request) {
+	Response(w).Status(http.StatusTooManyRequests).WithBody(Localize(req, "too many requests")).AsTextPlain()
+}
+
+func RateLimit(options RateLimitOptions) ChainHandler {
+	if options.Key == nil {
+		options.Key = KeyByIP
+	}
+	if options.ErrorHandler == nil {
+		options.ErrorHandler = defaultRateLimitErr
+	}
+	return func(w http.ResponseWriter, req *http.Request) bool {
+		result := options.Limiter.Allow(fmt.Sprintf("%s:%s", options.Scope, options.Key(req)))
+		header := w.Header()
+		header.Set(client.XRatelimitLimit, strconv.Itoa(result.Limit))
+		header.Set(client.XRatelimitRemaining, strconv.Itoa(result.Remaining))
+		header.Set(client.XRatelimitReset, strconv.FormatInt(result.Reset.Unix(), 10))
+		if !result.Allowed {
+			header.Set(client.RetryAfter, strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+			options.ErrorHandler(w, req)
+			return false
+		}
+		return true
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	limiter := TokenBucket(1, time.Second, 3, NewMemoryRateLimitStore(4)).(*tokenBucket)
+	limiter.now = clock.now
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("k").Allowed {
+			t.Errorf("request %d should be allowed", i)
+		}
+	}
+	result := limiter.Allow("k")
+	if result.Allowed {
+		t.Errorf("burst exceeded, request should be denied")
+	}
+	if result.RetryAfter != time.Second {
+		t.Errorf("got retry after %s, want %s", result.RetryAfter, time.Second)
+	}
+	clock.t = clock.t.Add(time.Second)
+	if !limiter.Allow("k").Allowed {
+		t.Errorf("token should have been refilled")
+	}
+	if !limiter.Allow("other").Allowed {
+		t.Errorf("keys should not share buckets")
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	clock := &fakeClock{time.Unix(1000, 0)}
+	limiter := SlidingWindow(2, 10*time.Second, NewMemoryRateLimitStore(1)).(*slidingWindow)
+	limiter.now = clock.now
+	limiter.Allow("k")
+	limiter.Allow("k")
+	if limiter.Allow("k").Allowed {
+		t.Errorf("limit exceeded, request should be denied")
+	}
+	clock.t = clock.t.Add(15 * time.Second)
+	if result := limiter.Allow("k"); !result.Allowed {
+		t.Errorf("half of the previous window should have expired, got %+v", result)
+	}
+	if limiter.Allow("k").Allowed {
+		t.Errorf("weighted previous window should deny")
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	handler := Handle(RateLimit(RateLimitOptions{
+		Limiter: TokenBucket(1, time.Minute, 1, NewMemoryRateLimitStore(1)),
+	}), func(w http.ResponseWriter, req *http.Request) {
+		Response(w).WithBody("ok").AsTextPlain()
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get(client.XRatelimitRemaining) != "0" {
+		t.Errorf("got status %d remaining %q", rec.Code, rec.Header().Get(client.XRatelimitRemaining))
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get(client.RetryAfter) != "60" {
+		t.Errorf("got status %d retry after %q", rec.Code, rec.Header().Get(client.RetryAfter))
+	}
+}
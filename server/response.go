@@ -3,6 +3,7 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"io"
 	"net/http"
 )
@@ -12,6 +13,7 @@ type ResponseBuilder interface {
 	WithBody(body any) ResponseBuilder
 	WithHeader(key, value string) ResponseBuilder
 	WithCookie(cookie *http.Cookie) ResponseBuilder
+	WithTemplate(req *http.Request, tmpl *template.Template, data any) ResponseBuilder
 	Redirect(redirect string)
 	As(contentType string)
 	AsTextPlain()
@@ -49,6 +51,21 @@ func (rb *responseBuilder) WithCookie(cookie *http.Cookie) ResponseBuilder {
 	return rb
 }
 
+type TemplateData struct {
+	Nonce     string
+	CsrfField template.HTML
+	Data      any
+}
+
+func (rb *responseBuilder) WithTemplate(req *http.Request, tmpl *template.Template, data any) ResponseBuilder {
+	rb.body = func(w io.Writer) {
+		if err := tmpl.Execute(w, TemplateData{Nonce: CSPNonce(req), CsrfField: CsrfField(req), Data: data}); err != nil {
+			panic(err)
+		}
+	}
+	return rb
+}
+
 func (rb *responseBuilder) writeBody() {
 	if rb.body == nil {
 		return
@@ -89,6 +106,13 @@ func (rb *responseBuilder) AsHtml() {
 	rb.As("text/html")
 }
 
+// Redirect responds with a page replacing the location with redirect. The
+// target is only carried in an escaped attribute, so the script allowed by
+// the CSP nonce never contains request data.
 func (rb *responseBuilder) Redirect(redirect string) {
-	rb.WithBody(fmt.Sprintf(`<html><header><script>window.location.replace("%s");</script></header><body></body></html>`, redirect)).AsHtml()
+	script := "<script>"
+	if nonce := nonceFromHeader(rb.w.Header()); nonce != "" {
+		script = fmt.Sprintf(`<script nonce="%s">`, nonce)
+	}
+	rb.WithBody(fmt.Sprintf(`<html><head><meta name="redirect" content="%s">%swindow.location.replace(document.querySelector('meta[name="redirect"]').content);</script></head><body></body></html>`, template.HTMLEscapeString(redirect), script)).AsHtml()
 }
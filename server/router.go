@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"runtime/debug"
 
 	"github.com/enolgor/go-utils-mm/server/path"
 )
@@ -11,6 +12,10 @@ type Router struct {
 	routes      []route
 	notFound    http.HandlerFunc
 	internalErr http.HandlerFunc
+	middlewares []Middleware
+	handler     http.Handler
+	reporters   []PanicReporter
+	production  bool
 }
 
 type RouterBuilder struct {
@@ -53,6 +58,26 @@ func (r *RouterBuilder) Delete(pathExpr string, handler http.HandlerFunc) *Route
 	return r.register("DELETE", pathExpr, handler)
 }
 
+func (r *RouterBuilder) Options(pathExpr string, handler http.HandlerFunc) *RouterBuilder {
+	return r.register("OPTIONS", pathExpr, handler)
+}
+
+func (r *RouterBuilder) Use(middlewares ...Middleware) *RouterBuilder {
+	r.router.middlewares = append(r.router.middlewares, middlewares...)
+	return r
+}
+
+func (r *RouterBuilder) PanicReporters(reporters ...PanicReporter) *RouterBuilder {
+	r.router.reporters = append(r.router.reporters, reporters...)
+	return r
+}
+
+// Production hides panic details from the default internal error response.
+func (r *RouterBuilder) Production() *RouterBuilder {
+	r.router.production = true
+	return r
+}
+
 func (r *RouterBuilder) NotFound(handler http.HandlerFunc) *RouterBuilder {
 	r.router.notFound = handler
 	return r
@@ -64,15 +89,21 @@ func (r *RouterBuilder) InternalErr(handler http.HandlerFunc) *RouterBuilder {
 }
 
 var defaultNotFound = func(w http.ResponseWriter, req *http.Request) {
-	Response(w).Status(http.StatusNotFound).WithBody(fmt.Sprintf("%s %s not found", req.Method, req.URL.Path)).AsTextPlain()
+	Response(w).Status(http.StatusNotFound).WithBody(Localize(req, "%s %s not found", req.Method, req.URL.Path)).AsTextPlain()
 }
 
-var defaultInternalErr = func(w http.ResponseWriter, req *http.Request) {
-	err := Recover(req)
-	if err == nil {
-		err = "uknown"
+func defaultInternalErr(production bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if production {
+			Response(w).Status(http.StatusInternalServerError).WithBody(Localize(req, "internal server error")).AsTextPlain()
+			return
+		}
+		var err any = "uknown"
+		if rec := Recover(req); rec != nil {
+			err = rec
+		}
+		Response(w).Status(http.StatusInternalServerError).WithBody(fmt.Sprintf("internal server error: %v", err)).AsTextPlain()
 	}
-	Response(w).Status(http.StatusInternalServerError).WithBody(fmt.Sprintf("internal server error: %s", err)).AsTextPlain()
 }
 
 func (r *RouterBuilder) Build() (*Router, error) {
@@ -86,8 +117,9 @@ func (r *RouterBuilder) Build() (*Router, error) {
 		r.router.notFound = defaultNotFound
 	}
 	if r.router.internalErr == nil {
-		r.router.internalErr = defaultInternalErr
+		r.router.internalErr = defaultInternalErr(r.router.production)
 	}
+	r.router.handler = Chain(http.HandlerFunc(r.router.serve), r.router.middlewares...)
 	return r.router, nil
 }
 
@@ -96,6 +128,7 @@ type routerContextKey int
 const (
 	pathParamsKey routerContextKey = iota
 	panicKey
+	routeExprKey
 )
 
 func PathParams(req *http.Request) map[any]string {
@@ -104,23 +137,70 @@ func PathParams(req *http.Request) map[any]string {
 	return values
 }
 
+func RouteExpr(req *http.Request) string {
+	var expr string
+	GetContextValue(req, routeExprKey, &expr)
+	return expr
+}
+
+// Recover returns the value recovered from the panic being answered by the
+// internal error handler.
 func Recover(req *http.Request) any {
-	var err any
-	GetContextValue(req, panicKey, &err)
-	return err
+	if p := RecoverPanic(req); p != nil {
+		return p.Value
+	}
+	return nil
 }
 
+// RecoverPanic returns the panic being answered by the internal error
+// handler, with the stack where it happened.
+func RecoverPanic(req *http.Request) *Panic {
+	var p *Panic
+	GetContextValue(req, panicKey, &p)
+	return p
+}
+
+// ServeHTTP also recovers panics of the middlewares, the ones of the routes
+// are recovered inside the middlewares so they still see the error response.
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	defer func() {
-		if rec := recover(); rec != nil {
-			AddContextValue(req, panicKey, rec)
-			r.internalErr(w, req)
-		}
-	}()
+	rw := wrapResponseWriter(w)
+	defer r.handlePanic(rw, req)
+	r.handler.ServeHTTP(rw, req)
+}
+
+// handlePanic must be deferred, it reports a panic and answers it with the
+// internal error handler.
+func (r *Router) handlePanic(rw *responseWriter, req *http.Request) {
+	rec := recover()
+	if rec == nil {
+		return
+	}
+	if rec == http.ErrAbortHandler {
+		panic(rec)
+	}
+	p := &Panic{Value: rec, Stack: debug.Stack()}
+	AddContextValue(req, panicKey, p)
+	for _, report := range r.reporters {
+		report(req, p)
+	}
+	if !rw.discard() {
+		// the status and part of the body are already on the wire, abort
+		// the connection so the client can't take the truncated response
+		// as complete
+		panic(http.ErrAbortHandler)
+	}
+	r.internalErr(rw, req)
+}
+
+func (r *Router) serve(w http.ResponseWriter, req *http.Request) {
+	rw := wrapResponseWriter(w)
+	w = rw
+	defer r.handlePanic(rw, req)
 	pathParams := make(map[any]string)
 	for _, route := range r.routes {
 		if req.Method == route.method && route.matcher(req.URL.Path, pathParams) {
 			AddContextValue(req, pathParamsKey, pathParams)
+			AddContextValue(req, routeExprKey, route.pathExpr)
 			route.handler(w, req)
 			return
 		}
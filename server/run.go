@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type Hook func(ctx context.Context) error
+
+type ServerConfig struct {
+	Addr              string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout bounds how long in-flight requests are drained after
+	// the context is cancelled or a SIGINT/SIGTERM is received.
+	ShutdownTimeout time.Duration
+	// ShutdownDelay keeps the listeners open after the OnShutdown hooks run
+	// and before draining starts, so load balancers can observe a failing
+	// readiness check and stop routing new requests.
+	ShutdownDelay time.Duration
+
+	// TLS is enabled when files, in-memory certificates or a TLSConfig with
+	// certificates are provided.
+	CertFile     string
+	KeyFile      string
+	Certificates []tls.Certificate
+	TLSConfig    *tls.Config
+
+	// RedirectAddr serves plain HTTP redirecting every request to HTTPS, it
+	// requires TLS.
+	RedirectAddr string
+	// AdminAddr serves AdminHandler, both must be set.
+	AdminAddr    string
+	AdminHandler http.Handler
+
+	BeforeStart []Hook
+	// OnShutdown hooks run as soon as shutdown starts, before draining.
+	OnShutdown []Hook
+	AfterStop  []Hook
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Addr:              ":8080",
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		ShutdownTimeout:   30 * time.Second,
+	}
+}
+
+func (cfg *ServerConfig) setDefaults() {
+	def := DefaultServerConfig()
+	if cfg.Addr == "" {
+		cfg.Addr = def.Addr
+	}
+	if cfg.ReadHeaderTimeout == 0 {
+		cfg.ReadHeaderTimeout = def.ReadHeaderTimeout
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = def.ReadTimeout
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = def.WriteTimeout
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = def.IdleTimeout
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = def.ShutdownTimeout
+	}
+}
+
+func (cfg *ServerConfig) tlsConfig() (*tls.Config, error) {
+	var config *tls.Config
+	if cfg.TLSConfig != nil {
+		config = cfg.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	config.Certificates = append(config.Certificates, cfg.Certificates...)
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return nil, nil
+	}
+	return config, nil
+}
+
+func (cfg *ServerConfig) newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+func httpsRedirect(httpsAddr string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + req.URL.RequestURI()
+		http.Redirect(w, req, target, http.StatusPermanentRedirect)
+	}
+}
+
+type listener struct {
+	name   string
+	server *http.Server
+	ln     net.Listener
+}
+
+func runHooks(ctx context.Context, hooks []Hook) error {
+	var errs []error
+	for _, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run serves handler until ctx is cancelled or the process receives SIGINT or
+// SIGTERM, then drains in-flight requests within cfg.ShutdownTimeout.
+func Run(ctx context.Context, cfg ServerConfig, handler http.Handler) error {
+	cfg.setDefaults()
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return fmt.Errorf("loading tls config: %w", err)
+	}
+	if cfg.RedirectAddr != "" && tlsConfig == nil {
+		return errors.New("invalid config: RedirectAddr requires TLS")
+	}
+	if (cfg.AdminAddr == "") != (cfg.AdminHandler == nil) {
+		return errors.New("invalid config: AdminAddr and AdminHandler must be set together")
+	}
+	if err = runHooks(ctx, cfg.BeforeStart); err != nil {
+		return fmt.Errorf("before start: %w", err)
+	}
+
+	listeners := []*listener{}
+	mainServer := cfg.newServer(handler)
+	mainServer.TLSConfig = tlsConfig
+	listeners = append(listeners, &listener{name: "main", server: mainServer})
+	if cfg.RedirectAddr != "" {
+		listeners = append(listeners, &listener{name: "redirect", server: cfg.newServer(httpsRedirect(cfg.Addr))})
+	}
+	if cfg.AdminAddr != "" {
+		listeners = append(listeners, &listener{name: "admin", server: cfg.newServer(cfg.AdminHandler)})
+	}
+	addrs := map[string]string{"main": cfg.Addr, "redirect": cfg.RedirectAddr, "admin": cfg.AdminAddr}
+	for _, l := range listeners {
+		if l.ln, err = net.Listen("tcp", addrs[l.name]); err != nil {
+			for _, opened := range listeners {
+				if opened.ln != nil {
+					opened.ln.Close()
+				}
+			}
+			return fmt.Errorf("listening %s on %s: %w", l.name, addrs[l.name], err)
+		}
+	}
+
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			var err error
+			if l.server.TLSConfig != nil {
+				err = l.server.ServeTLS(l.ln, "", "")
+			} else {
+				err = l.server.Serve(l.ln)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("serving %s: %w", l.name, err)
+			}
+		}(l)
+	}
+
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-errCh:
+	}
+	stop()
+
+	hooksCtx, cancelHooks := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	errs := []error{serveErr, runHooks(hooksCtx, cfg.OnShutdown)}
+	cancelHooks()
+	time.Sleep(cfg.ShutdownDelay)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			if err := l.server.Shutdown(shutdownCtx); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("shutting down %s: %w", l.name, err))
+				mu.Unlock()
+			}
+		}(l)
+	}
+	wg.Wait()
+	errs = append(errs, runHooks(context.Background(), cfg.AfterStop))
+	return errors.Join(errs...)
+}
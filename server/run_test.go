@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunConfigErrors(t *testing.T) {
+	handler := http.NotFoundHandler()
+	cases := map[string]ServerConfig{
+		"redirect without tls":       {Addr: "127.0.0.1:0", RedirectAddr: "127.0.0.1:0"},
+		"admin without handler":      {Addr: "127.0.0.1:0", AdminAddr: "127.0.0.1:0"},
+		"admin handler without addr": {Addr: "127.0.0.1:0", AdminHandler: handler},
+	}
+	for name, cfg := range cases {
+		started := false
+		cfg.BeforeStart = []Hook{func(context.Context) error { started = true; return nil }}
+		if err := Run(context.Background(), cfg, handler); err == nil || !strings.Contains(err.Error(), "invalid config") {
+			t.Errorf("%s: expected a config error, got %v", name, err)
+		}
+		if started {
+			t.Errorf("%s: expected to fail before starting", name)
+		}
+	}
+}
+
+func TestRunLifecycle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var events []string
+	hook := func(event string) Hook {
+		return func(context.Context) error {
+			events = append(events, event)
+			if event == "before" {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					cancel()
+				}()
+			}
+			return nil
+		}
+	}
+	cfg := ServerConfig{
+		Addr:         "127.0.0.1:0",
+		AdminAddr:    "127.0.0.1:0",
+		AdminHandler: http.NotFoundHandler(),
+		BeforeStart:  []Hook{hook("before")},
+		OnShutdown:   []Hook{hook("shutdown")},
+		AfterStop:    []Hook{hook("after")},
+	}
+	done := make(chan error)
+	go func() { done <- Run(ctx, cfg, http.NotFoundHandler()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to return once the context is cancelled")
+	}
+	if strings.Join(events, ",") != "before,shutdown,after" {
+		t.Errorf("expected hooks in order, got %v", events)
+	}
+}
+
+func TestRunShutdownDelay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	health := NewHealth(HealthOptions{})
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", health.ReadinessHandler())
+	ctx, cancel := context.WithCancel(context.Background())
+	draining := make(chan struct{})
+	cfg := ServerConfig{
+		Addr:          addr,
+		ShutdownDelay: 500 * time.Millisecond,
+		OnShutdown: []Hook{health.ShutdownHook(), func(context.Context) error {
+			close(draining)
+			return nil
+		}},
+	}
+	done := make(chan error)
+	go func() { done <- Run(ctx, cfg, mux) }()
+	ready := func() int {
+		resp, err := http.Get("http://" + addr + "/readyz")
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 0; ready() != http.StatusOK; i++ {
+		if i == 100 {
+			t.Fatal("expected the server to become ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-draining
+	if status := ready(); status != http.StatusServiceUnavailable {
+		t.Errorf("expected readiness to fail while the listeners are open, got %d", status)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if ready() != 0 {
+		t.Error("expected the listeners to be closed after the delay")
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	cases := map[string]string{
+		":443":  "https://example.com/path?q=1",
+		":8443": "https://example.com:8443/path?q=1",
+	}
+	for addr, expected := range cases {
+		rec := httptest.NewRecorder()
+		httpsRedirect(addr)(rec, httptest.NewRequest(http.MethodGet, "http://example.com:8080/path?q=1", nil))
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != expected {
+			t.Errorf("%s: expected redirect to %s, got %d %s", addr, expected, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+const (
+	CSPSelf          = "'self'"
+	CSPNone          = "'none'"
+	CSPUnsafeInline  = "'unsafe-inline'"
+	CSPStrictDynamic = "'strict-dynamic'"
+	// CSPNonceSource is replaced by 'nonce-<value>' with the nonce of each request.
+	CSPNonceSource = "'nonce'"
+)
+
+type cspDirective struct {
+	name    string
+	sources []string
+}
+
+type CSPBuilder struct {
+	directives []cspDirective
+}
+
+func NewCSP() *CSPBuilder {
+	return &CSPBuilder{directives: []cspDirective{}}
+}
+
+func (c *CSPBuilder) Directive(name string, sources ...string) *CSPBuilder {
+	for i := range c.directives {
+		if c.directives[i].name == name {
+			c.directives[i].sources = append(c.directives[i].sources, sources...)
+			return c
+		}
+	}
+	c.directives = append(c.directives, cspDirective{name, sources})
+	return c
+}
+
+func (c *CSPBuilder) DefaultSrc(sources ...string) *CSPBuilder {
+	return c.Directive("default-src", sources...)
+}
+
+func (c *CSPBuilder) ScriptSrc(sources ...string) *CSPBuilder {
+	return c.Directive("script-src", sources...)
+}
+
+func (c *CSPBuilder) StyleSrc(sources ...string) *CSPBuilder {
+	return c.Directive("style-src", sources...)
+}
+
+func (c *CSPBuilder) ImgSrc(sources ...string) *CSPBuilder {
+	return c.Directive("img-src", sources...)
+}
+
+func (c *CSPBuilder) ConnectSrc(sources ...string) *CSPBuilder {
+	return c.Directive("connect-src", sources...)
+}
+
+func (c *CSPBuilder) FontSrc(sources ...string) *CSPBuilder {
+	return c.Directive("font-src", sources...)
+}
+
+func (c *CSPBuilder) ObjectSrc(sources ...string) *CSPBuilder {
+	return c.Directive("object-src", sources...)
+}
+
+func (c *CSPBuilder) FrameAncestors(sources ...string) *CSPBuilder {
+	return c.Directive("frame-ancestors", sources...)
+}
+
+func (c *CSPBuilder) BaseURI(sources ...string) *CSPBuilder {
+	return c.Directive("base-uri", sources...)
+}
+
+func (c *CSPBuilder) FormAction(sources ...string) *CSPBuilder {
+	return c.Directive("form-action", sources...)
+}
+
+func (c *CSPBuilder) UpgradeInsecureRequests() *CSPBuilder {
+	return c.Directive("upgrade-insecure-requests")
+}
+
+func (c *CSPBuilder) ReportURI(uri string) *CSPBuilder {
+	return c.Directive("report-uri", uri)
+}
+
+func (c *CSPBuilder) usesNonce() bool {
+	for _, d := range c.directives {
+		for _, source := range d.sources {
+			if source == CSPNonceSource {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *CSPBuilder) Build(nonce string) string {
+	parts := make([]string, len(c.directives))
+	for i, d := range c.directives {
+		sources := make([]string, len(d.sources))
+		for j, source := range d.sources {
+			if source == CSPNonceSource {
+				source = fmt.Sprintf("'nonce-%s'", nonce)
+			}
+			sources[j] = source
+		}
+		parts[i] = strings.TrimSpace(d.name + " " + strings.Join(sources, " "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func StrictCSP() *CSPBuilder {
+	return NewCSP().
+		DefaultSrc(CSPSelf).
+		ScriptSrc(CSPNonceSource, CSPStrictDynamic).
+		StyleSrc(CSPSelf, CSPNonceSource).
+		ObjectSrc(CSPNone).
+		BaseURI(CSPNone).
+		FrameAncestors(CSPNone)
+}
+
+type SecurityOptions struct {
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+	ContentTypeNosniff    bool
+	FrameOptions          string
+	ReferrerPolicy        string
+	PermissionsPolicy     string
+	CSP                   *CSPBuilder
+	CSPReportOnly         bool
+}
+
+func DefaultSecurityOptions() SecurityOptions {
+	return SecurityOptions{
+		HSTSMaxAge:            365 * 24 * time.Hour,
+		HSTSIncludeSubdomains: true,
+		ContentTypeNosniff:    true,
+		FrameOptions:          "DENY",
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+		PermissionsPolicy:     "camera=(), microphone=(), geolocation=()",
+		CSP:                   StrictCSP(),
+	}
+}
+
+type securityContextKey int
+
+const cspNonceKey securityContextKey = iota
+
+func SecurityHeaders(options SecurityOptions) ChainHandler {
+	var hsts string
+	if options.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", int(options.HSTSMaxAge.Seconds()))
+		if options.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if options.HSTSPreload {
+			hsts += "; preload"
+		}
+	}
+	cspHeader := client.ContentSecurityPolicy
+	if options.CSPReportOnly {
+		cspHeader = client.ContentSecurityPolicyReportOnly
+	}
+	return func(w http.ResponseWriter, req *http.Request) bool {
+		header := w.Header()
+		if hsts != "" && isHTTPS(req) {
+			header.Set(client.StrictTransportSecurity, hsts)
+		}
+		if options.ContentTypeNosniff {
+			header.Set(client.XContentTypeOptions, "nosniff")
+		}
+		if options.FrameOptions != "" {
+			header.Set(client.XFrameOptions, options.FrameOptions)
+		}
+		if options.ReferrerPolicy != "" {
+			header.Set(client.ReferrerPolicy, options.ReferrerPolicy)
+		}
+		if options.PermissionsPolicy != "" {
+			header.Set(client.PermissionsPolicy, options.PermissionsPolicy)
+		}
+		if options.CSP != nil {
+			var nonce string
+			if options.CSP.usesNonce() {
+				nonce = newNonce()
+				AddContextValue(req, cspNonceKey, nonce)
+			}
+			header.Set(cspHeader, options.CSP.Build(nonce))
+		}
+		return true
+	}
+}
+
+func CSPNonce(req *http.Request) string {
+	var nonce string
+	GetContextValue(req, cspNonceKey, &nonce)
+	return nonce
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+// nonceFromHeader recovers the nonce from an already set policy so builders
+// without access to the request, like Redirect, can emit allowed scripts.
+func nonceFromHeader(header http.Header) string {
+	policy := header.Get(client.ContentSecurityPolicy)
+	if policy == "" {
+		policy = header.Get(client.ContentSecurityPolicyReportOnly)
+	}
+	idx := strings.Index(policy, "'nonce-")
+	if idx == -1 {
+		return ""
+	}
+	policy = policy[idx+len("'nonce-"):]
+	if end := strings.Index(policy, "'"); end != -1 {
+		return policy[:end]
+	}
+	return ""
+}
+
+// isHTTPS doesn't read X-Forwarded-Proto, clients can set it, the scheme
+// forwarded by trusted proxies is set on the URL by TrustProxies.
+func isHTTPS(req *http.Request) bool {
+	return req.TLS != nil || req.URL.Scheme == "https"
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	handler := Handle(SecurityHeaders(DefaultSecurityOptions()), func(w http.ResponseWriter, req *http.Request) {
+		Response(w).WithBody(CSPNonce(req)).AsTextPlain()
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(client.XForwardedProto, "https")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	header := rec.Header()
+	if header.Get(client.StrictTransportSecurity) != "" {
+		t.Error("expected no HSTS over plain HTTP, even with a client sent X-Forwarded-Proto")
+	}
+	expected := map[string]string{
+		client.XContentTypeOptions: "nosniff",
+		client.XFrameOptions:       "DENY",
+		client.ReferrerPolicy:      "strict-origin-when-cross-origin",
+	}
+	for name, value := range expected {
+		if header.Get(name) != value {
+			t.Errorf("expected %s %q, got %q", name, value, header.Get(name))
+		}
+	}
+	nonce := rec.Body.String()
+	if nonce == "" || !strings.Contains(header.Get(client.ContentSecurityPolicy), "'nonce-"+nonce+"'") {
+		t.Errorf("expected policy with the request nonce %q, got %q", nonce, header.Get(client.ContentSecurityPolicy))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if hsts := rec.Header().Get(client.StrictTransportSecurity); hsts != "max-age=31536000; includeSubDomains" {
+		t.Errorf("expected HSTS over TLS, got %q", hsts)
+	}
+	if rec.Body.String() == nonce {
+		t.Error("expected a new nonce per request")
+	}
+}
+
+func TestSecurityHeadersReportOnly(t *testing.T) {
+	options := DefaultSecurityOptions()
+	options.CSPReportOnly = true
+	handler := Handle(SecurityHeaders(options), func(w http.ResponseWriter, req *http.Request) {
+		Response(w).Redirect("/next")
+	})
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	policy := rec.Header().Get(client.ContentSecurityPolicyReportOnly)
+	if policy == "" || rec.Header().Get(client.ContentSecurityPolicy) != "" {
+		t.Fatalf("expected only the report-only policy, got %v", rec.Header())
+	}
+	nonce := nonceFromHeader(rec.Header())
+	if nonce == "" || !strings.Contains(rec.Body.String(), `<script nonce="`+nonce+`">`) {
+		t.Errorf("expected redirect script allowed by the policy nonce, got %s", rec.Body)
+	}
+}
+
+func TestRedirectEscapesTarget(t *testing.T) {
+	ja := NewJwtAuth([]byte("secret"), time.Hour, func(user, pass string) (bool, error) {
+		return true, nil
+	})
+	handler := Handle(SecurityHeaders(DefaultSecurityOptions()), ja.LoginHandler())
+	form := url.Values{"user": {"alice"}, "pass": {"pw"}}
+	req := httptest.NewRequest(http.MethodPost, "/login?redirect="+url.QueryEscape(`/");alert(document.cookie)//`), strings.NewReader(form.Encode()))
+	req.Header.Set(client.ContentType, "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	body := rec.Body.String()
+	if strings.Contains(body, `");alert(`) || !strings.Contains(body, `content="/&#34;);alert(document.cookie)//"`) {
+		t.Errorf("expected the target to be escaped out of the script, got %s", body)
+	}
+	nonce := nonceFromHeader(rec.Header())
+	script := `<script nonce="` + nonce + `">window.location.replace(document.querySelector('meta[name="redirect"]').content);</script>`
+	if nonce == "" || !strings.Contains(body, script) {
+		t.Errorf("expected only the static script to carry the nonce, got %s", body)
+	}
+}
@@ -9,6 +9,7 @@ import (
 )
 
 type ChainHandler func(http.ResponseWriter, *http.Request) bool
+type Middleware func(http.Handler) http.Handler
 type contextKey any
 
 func Method(method string) ChainHandler {
@@ -67,6 +68,23 @@ func Handle(handlers ...any) func(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (ch ChainHandler) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if ch(w, req) {
+				next.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
 func AddContextValue(req *http.Request, key, value any) {
 	r := req.WithContext(context.WithValue(req.Context(), contextKey(key), value))
 	*req = *r
@@ -0,0 +1,320 @@
+package servertest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"github.com/enolgor/go-utils-mm/server"
+)
+
+const BaseURL = "https://example.com"
+
+// Server drives requests through a handler, usually a *server.Router, without
+// a network. Cookies set by responses are kept and sent on later requests.
+type Server struct {
+	handler http.Handler
+	jar     *cookiejar.Jar
+	auth    *server.JwtAuth
+}
+
+func New(handler http.Handler) *Server {
+	jar, _ := cookiejar.New(nil)
+	return &Server{handler: handler, jar: jar}
+}
+
+// WithAuth sets the JwtAuth used to mint tokens for Request.AsUser.
+func (s *Server) WithAuth(auth *server.JwtAuth) *Server {
+	s.auth = auth
+	return s
+}
+
+func (s *Server) ClearCookies() {
+	s.jar, _ = cookiejar.New(nil)
+}
+
+func (s *Server) do(req *http.Request) (*http.Response, error) {
+	for _, c := range s.jar.Cookies(req.URL) {
+		req.AddCookie(c)
+	}
+	if req.URL.Scheme == "https" {
+		req.TLS = &tls.ConnectionState{}
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.RequestURI = req.URL.RequestURI()
+	rec := httptest.NewRecorder()
+	s.handler.ServeHTTP(rec, req)
+	resp := rec.Result()
+	resp.Request = req
+	s.jar.SetCookies(req.URL, resp.Cookies())
+	return resp, nil
+}
+
+func (s *Server) Request(method, path string) *Request {
+	target := path
+	if !strings.Contains(path, "://") {
+		target = BaseURL + path
+	}
+	r := &Request{server: s, req: client.NewRequest(method, target)}
+	r.req.WithDoer(s.do)
+	return r
+}
+
+func (s *Server) Get(path string) *Request {
+	return s.Request(http.MethodGet, path)
+}
+
+func (s *Server) Post(path string) *Request {
+	return s.Request(http.MethodPost, path)
+}
+
+func (s *Server) Put(path string) *Request {
+	return s.Request(http.MethodPut, path)
+}
+
+func (s *Server) Patch(path string) *Request {
+	return s.Request(http.MethodPatch, path)
+}
+
+func (s *Server) Delete(path string) *Request {
+	return s.Request(http.MethodDelete, path)
+}
+
+type Request struct {
+	server    *Server
+	req       *client.Request
+	cookies   []*http.Cookie
+	principal *server.Principal
+}
+
+func (r *Request) WithHeader(key, value string) *Request {
+	r.req.WithHeader(key, value)
+	return r
+}
+
+func (r *Request) WithHeaders(headers map[string]string) *Request {
+	r.req.WithHeaders(headers)
+	return r
+}
+
+func (r *Request) WithBody(body any) *Request {
+	r.req.WithBody(body)
+	return r
+}
+
+func (r *Request) WithFormValue(key, value string) *Request {
+	r.req.WithFormValue(key, value)
+	return r
+}
+
+func (r *Request) WithCookie(cookie *http.Cookie) *Request {
+	r.cookies = append(r.cookies, cookie)
+	return r
+}
+
+// AsUser authenticates the request with a token minted for subject by the
+// JwtAuth set with Server.WithAuth.
+func (r *Request) AsUser(subject string) *Request {
+	return r.AsPrincipal(&server.Principal{Subject: subject})
+}
+
+// AsPrincipal is AsUser for a principal with roles, scopes or claims.
+func (r *Request) AsPrincipal(principal *server.Principal) *Request {
+	r.principal = principal
+	return r
+}
+
+// Expect sends the request and returns the response to assert on, failing the
+// test if the request couldn't be sent.
+func (r *Request) Expect(t testing.TB) *Response {
+	t.Helper()
+	cookies := r.cookies
+	if r.principal != nil {
+		if r.server.auth == nil {
+			t.Fatal("AsUser and AsPrincipal require Server.WithAuth")
+		}
+		cookie, err := r.server.auth.PrincipalCookie(r.principal)
+		if err != nil {
+			t.Fatalf("minting token: %s", err)
+		}
+		cookies = append(cookies, cookie)
+	}
+	if len(cookies) > 0 {
+		values := make([]string, len(cookies))
+		for i, c := range cookies {
+			values[i] = (&http.Cookie{Name: c.Name, Value: c.Value}).String()
+		}
+		r.req.WithHeader(client.Cookie, strings.Join(values, "; "))
+	}
+	resp, err := r.req.Do()
+	if err != nil {
+		t.Fatalf("sending request: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %s", err)
+	}
+	return &Response{Response: resp, Body: body, t: t}
+}
+
+type Response struct {
+	*http.Response
+	Body []byte
+	t    testing.TB
+}
+
+func (r *Response) Status(status int) *Response {
+	r.t.Helper()
+	if r.StatusCode != status {
+		r.t.Errorf("expected status %d, got %d: %s", status, r.StatusCode, r.Body)
+	}
+	return r
+}
+
+func (r *Response) Header(key, value string) *Response {
+	r.t.Helper()
+	if got := r.Response.Header.Get(key); got != value {
+		r.t.Errorf("expected header %s to be %q, got %q", key, value, got)
+	}
+	return r
+}
+
+func (r *Response) NoHeader(key string) *Response {
+	r.t.Helper()
+	if values := r.Response.Header.Values(key); len(values) > 0 {
+		r.t.Errorf("expected no header %s, got %q", key, values)
+	}
+	return r
+}
+
+func (r *Response) BodyContains(s string) *Response {
+	r.t.Helper()
+	if !bytes.Contains(r.Body, []byte(s)) {
+		r.t.Errorf("expected body to contain %q, got %q", s, r.Body)
+	}
+	return r
+}
+
+func (r *Response) findCookie(name string) *http.Cookie {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Cookie asserts the response sets the cookie name to value, any value is
+// accepted when value is empty.
+func (r *Response) Cookie(name, value string) *Response {
+	r.t.Helper()
+	c := r.findCookie(name)
+	switch {
+	case c == nil:
+		r.t.Errorf("expected cookie %s to be set", name)
+	case c.MaxAge < 0:
+		r.t.Errorf("expected cookie %s to be set, it was cleared", name)
+	case value != "" && c.Value != value:
+		r.t.Errorf("expected cookie %s to be %q, got %q", name, value, c.Value)
+	}
+	return r
+}
+
+func (r *Response) ClearsCookie(name string) *Response {
+	r.t.Helper()
+	if c := r.findCookie(name); c == nil || c.MaxAge >= 0 {
+		r.t.Errorf("expected cookie %s to be cleared", name)
+	}
+	return r
+}
+
+var scriptRedirect = regexp.MustCompile(`<meta name="redirect" content="([^"]*)">`)
+
+// Redirect asserts the response redirects to location, either with a Location
+// header or with the script written by server.ResponseBuilder.Redirect.
+func (r *Response) Redirect(location string) *Response {
+	r.t.Helper()
+	got := r.Response.Header.Get(client.Location)
+	if got == "" {
+		if m := scriptRedirect.FindSubmatch(r.Body); m != nil {
+			got = html.UnescapeString(string(m[1]))
+		}
+	}
+	if got != location {
+		r.t.Errorf("expected redirect to %q, got %q", location, got)
+	}
+	return r
+}
+
+// JSON asserts the value found at the dot separated path of the JSON body is
+// equal to expected once both are encoded as JSON. Array elements are
+// addressed by index, as in "items.0.id", and the empty path is the whole body.
+func (r *Response) JSON(path string, expected any) *Response {
+	r.t.Helper()
+	got, err := jsonPath(r.Body, path)
+	if err != nil {
+		r.t.Errorf("json %q: %s", path, err)
+		return r
+	}
+	var want any
+	if b, err := json.Marshal(expected); err != nil {
+		r.t.Errorf("json %q: encoding expected value: %s", path, err)
+		return r
+	} else if err := json.Unmarshal(b, &want); err != nil {
+		r.t.Errorf("json %q: decoding expected value: %s", path, err)
+		return r
+	}
+	if !reflect.DeepEqual(got, want) {
+		r.t.Errorf("expected json %q to be %v, got %v", path, want, got)
+	}
+	return r
+}
+
+func (r *Response) DecodeJSON(v any) *Response {
+	r.t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		r.t.Errorf("decoding json body: %s", err)
+	}
+	return r
+}
+
+func jsonPath(body []byte, path string) (any, error) {
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return value, nil
+	}
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			var ok bool
+			if value, ok = v[part]; !ok {
+				return nil, fmt.Errorf("key %q not found", part)
+			}
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("invalid index %q", part)
+			}
+			value = v[i]
+		default:
+			return nil, fmt.Errorf("can't access %q in %T", part, value)
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,49 @@
+package servertest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/server"
+)
+
+func TestServer(t *testing.T) {
+	auth := server.NewJwtAuth([]byte("secret"), time.Hour, func(user, pass string) (bool, error) {
+		return user == "alice" && pass == "wonderland", nil
+	})
+	strict := auth.StrictAuthHandler("/login")
+	router, err := server.NewRouterBuilder().
+		Post("/login", auth.LoginHandler()).
+		Get("/me", server.Handle(server.Get, strict, func(w http.ResponseWriter, req *http.Request) bool {
+			subject, _ := server.JwtClaims(req).GetSubject()
+			server.Response(w).WithBody(map[string]any{"user": subject, "roles": []string{"admin"}}).AsJson()
+			return true
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(router).WithAuth(auth)
+
+	srv.Get("/me").Expect(t).
+		Status(http.StatusUnauthorized).
+		Redirect("/login?redirect=%2Fme")
+
+	srv.Get("/me").AsUser("bob").Expect(t).
+		Status(http.StatusOK).
+		Header("Content-Type", "application/json").
+		JSON("user", "bob").
+		JSON("roles.0", "admin")
+
+	srv.Post("/login?redirect=/me").
+		WithFormValue("user", "alice").
+		WithFormValue("pass", "wonderland").
+		Expect(t).
+		Cookie("_token", "").
+		Redirect("/me")
+
+	srv.Get("/me").Expect(t).
+		Status(http.StatusOK).
+		JSON("user", "alice")
+}
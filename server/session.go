@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/server/sessions"
+)
+
+type SessionOptions struct {
+	CookieName string
+	Path       string
+	Domain     string
+	Secure     bool
+	SameSite   http.SameSite
+	MaxAge     time.Duration
+}
+
+type sessionContextKey int
+
+const sessionKey sessionContextKey = iota
+
+// Sessions loads the session referenced by the session cookie before the
+// handler runs and saves it, if modified, right before the response headers
+// are written.
+func Sessions(store sessions.Store, options SessionOptions) Middleware {
+	if options.CookieName == "" {
+		options.CookieName = "_session"
+	}
+	if options.Path == "" {
+		options.Path = "/"
+	}
+	if options.SameSite == 0 {
+		options.SameSite = http.SameSiteLaxMode
+	}
+	if options.MaxAge == 0 {
+		options.MaxAge = 24 * time.Hour
+	}
+	cookie := func(value string, maxAge int) *http.Cookie {
+		return &http.Cookie{
+			Name:     options.CookieName,
+			Value:    value,
+			Path:     options.Path,
+			Domain:   options.Domain,
+			Secure:   options.Secure,
+			HttpOnly: true,
+			SameSite: options.SameSite,
+			MaxAge:   maxAge,
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var session *sessions.Session
+			if c, err := req.Cookie(options.CookieName); err == nil {
+				if session, err = store.Load(c.Value); err != nil {
+					Logger(req).Error("loading session", "error", err)
+				}
+			}
+			if session == nil {
+				session = sessions.New()
+			}
+			AddContextValue(req, sessionKey, session)
+			rw := wrapResponseWriter(w)
+			committed := false
+			commit := func() {
+				if committed || !session.Modified() {
+					return
+				}
+				committed = true
+				if session.Destroyed() {
+					if err := store.Delete(session); err != nil {
+						Logger(req).Error("deleting session", "error", err)
+					}
+					http.SetCookie(rw, cookie("", -1))
+					return
+				}
+				value, err := store.Save(session, time.Now().Add(options.MaxAge))
+				if err != nil {
+					Logger(req).Error("saving session", "error", err)
+					return
+				}
+				http.SetCookie(rw, cookie(value, int(options.MaxAge.Seconds())))
+			}
+			rw.onBeforeHeader(commit)
+			next.ServeHTTP(rw, req)
+			if !rw.Written() {
+				commit()
+			}
+		})
+	}
+}
+
+// Session returns the session of the request, or nil when the request didn't
+// go through the Sessions middleware.
+func Session(req *http.Request) *sessions.Session {
+	var session *sessions.Session
+	GetContextValue(req, sessionKey, &session)
+	return session
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/server/sessions"
+)
+
+func TestSessions(t *testing.T) {
+	router, err := NewRouterBuilder().
+		Use(Sessions(sessions.NewMemoryStore(time.Minute), SessionOptions{})).
+		Get("/read", func(w http.ResponseWriter, req *http.Request) {
+			var user string
+			Session(req).Get("user", &user)
+			Response(w).WithBody(user).AsTextPlain()
+		}).
+		Post("/login", func(w http.ResponseWriter, req *http.Request) {
+			Session(req).Rotate()
+			Session(req).Set("user", "alice")
+			Response(w).WithBody("ok").AsTextPlain()
+		}).
+		Post("/silent", func(w http.ResponseWriter, req *http.Request) {
+			Session(req).Set("visited", true)
+		}).
+		Get("/cached", func(w http.ResponseWriter, req *http.Request) {
+			Session(req).Set("seen", true)
+			w.WriteHeader(http.StatusNotModified)
+		}).
+		Post("/logout", func(w http.ResponseWriter, req *http.Request) {
+			Session(req).Destroy()
+			w.WriteHeader(http.StatusNoContent)
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(method, path string, cookies ...*http.Cookie) (*httptest.ResponseRecorder, *http.Cookie) {
+		req := httptest.NewRequest(method, path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "_session" {
+				return rec, c
+			}
+		}
+		return rec, nil
+	}
+
+	if _, c := send(http.MethodGet, "/read"); c != nil {
+		t.Error("expected an unmodified session to not be saved")
+	}
+	_, anonymous := send(http.MethodPost, "/silent")
+	if anonymous == nil || !anonymous.HttpOnly || anonymous.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("expected a session modified without writing to be saved, got %v", anonymous)
+	}
+	if _, c := send(http.MethodGet, "/cached", anonymous); c == nil {
+		t.Error("expected the session cookie on a 304")
+	}
+
+	_, session := send(http.MethodPost, "/login", anonymous)
+	if session == nil || session.Value == anonymous.Value {
+		t.Fatalf("expected login to regenerate the session id, got %v", session)
+	}
+	if rec, _ := send(http.MethodGet, "/read", session); rec.Body.String() != "alice" {
+		t.Errorf("expected the values to be kept, got %q", rec.Body)
+	}
+	if rec, _ := send(http.MethodGet, "/read", anonymous); rec.Body.String() != "" {
+		t.Errorf("expected the previous id to be dropped, got %q", rec.Body)
+	}
+
+	if _, c := send(http.MethodPost, "/logout", session); c == nil || c.MaxAge >= 0 {
+		t.Fatalf("expected logout to clear the cookie, got %v", c)
+	}
+	if rec, _ := send(http.MethodGet, "/read", session); rec.Body.String() != "" {
+		t.Errorf("expected the destroyed session to be deleted, got %q", rec.Body)
+	}
+}
+
+func TestSessionWithoutMiddleware(t *testing.T) {
+	if Session(httptest.NewRequest(http.MethodGet, "/", nil)) != nil {
+		t.Error("expected no session without the middleware")
+	}
+}
@@ -0,0 +1,154 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+	"time"
+)
+
+// Session values are kept as JSON so every store can persist them without
+// registering types.
+type Session struct {
+	ID      string                     `json:"id"`
+	Values  map[string]json.RawMessage `json:"values"`
+	Flashes map[string]json.RawMessage `json:"flashes"`
+	Expires time.Time                  `json:"expires"`
+
+	isNew      bool
+	modified   bool
+	destroyed  bool
+	previousID string
+}
+
+type Store interface {
+	// Load returns the session referenced by a cookie value, nil when it is
+	// missing, expired or invalid.
+	Load(value string) (*Session, error)
+	// Save persists the session until expires and returns the cookie value.
+	Save(session *Session, expires time.Time) (string, error)
+	Delete(session *Session) error
+}
+
+func New() *Session {
+	return &Session{
+		ID:      NewID(),
+		Values:  map[string]json.RawMessage{},
+		Flashes: map[string]json.RawMessage{},
+		isNew:   true,
+	}
+}
+
+func NewID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+var idRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+func ValidID(id string) bool {
+	return idRegexp.MatchString(id)
+}
+
+func (s *Session) Get(key string, value any) bool {
+	raw, ok := s.Values[key]
+	if !ok {
+		return false
+	}
+	return json.Unmarshal(raw, value) == nil
+}
+
+func (s *Session) Set(key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.Values[key] = raw
+	s.modified = true
+	return nil
+}
+
+func (s *Session) Delete(key string) {
+	if _, ok := s.Values[key]; ok {
+		delete(s.Values, key)
+		s.modified = true
+	}
+}
+
+// Flash stores a value that is removed the first time it is read with
+// TakeFlash.
+func (s *Session) Flash(key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.Flashes[key] = raw
+	s.modified = true
+	return nil
+}
+
+func (s *Session) TakeFlash(key string, value any) bool {
+	raw, ok := s.Flashes[key]
+	if !ok {
+		return false
+	}
+	delete(s.Flashes, key)
+	s.modified = true
+	return json.Unmarshal(raw, value) == nil
+}
+
+// Rotate assigns a new id keeping the values, call it on login to prevent
+// session fixation. The previous id is deleted from the store on save.
+func (s *Session) Rotate() {
+	if s.previousID == "" && !s.isNew {
+		s.previousID = s.ID
+	}
+	s.ID = NewID()
+	s.modified = true
+}
+
+func (s *Session) Destroy() {
+	s.destroyed = true
+	s.modified = true
+}
+
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+func (s *Session) Modified() bool {
+	return s.modified
+}
+
+func (s *Session) Destroyed() bool {
+	return s.destroyed
+}
+
+func (s *Session) PreviousID() string {
+	return s.previousID
+}
+
+func (s *Session) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && now.After(s.Expires)
+}
+
+func decode(data []byte, now time.Time) (*Session, error) {
+	s := &Session{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	if s.expired(now) {
+		return nil, nil
+	}
+	if s.Values == nil {
+		s.Values = map[string]json.RawMessage{}
+	}
+	if s.Flashes == nil {
+		s.Flashes = map[string]json.RawMessage{}
+	}
+	return s, nil
+}
@@ -0,0 +1,87 @@
+package sessions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCookieStore(t *testing.T) {
+	store := NewCookieStore([]byte("0123456789abcdef0123456789abcdef"), []byte("hash-key"))
+	session := New()
+	session.Set("cart", []string{"apple", "pear"})
+	session.Flash("notice", "saved")
+	value, err := store.Save(session, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load(value)
+	if err != nil || loaded == nil {
+		t.Fatalf("expected session, got %v, %v", loaded, err)
+	}
+	var cart []string
+	if !loaded.Get("cart", &cart) || len(cart) != 2 || cart[1] != "pear" {
+		t.Errorf("got cart %v", cart)
+	}
+	var notice string
+	if !loaded.TakeFlash("notice", &notice) || notice != "saved" {
+		t.Errorf("got flash %q", notice)
+	}
+	if loaded.TakeFlash("notice", &notice) {
+		t.Errorf("flash should be consumed")
+	}
+	if tampered, _ := store.Load(value[:len(value)-2] + "AA"); tampered != nil {
+		t.Errorf("tampered cookie should not load")
+	}
+	expired, _ := store.Save(New(), time.Now().Add(-time.Second))
+	if s, _ := store.Load(expired); s != nil {
+		t.Errorf("expired cookie should not load")
+	}
+}
+
+func TestFileStoreRotate(t *testing.T) {
+	store, err := NewFileStore(t.TempDir(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := New()
+	session.Set("user", "anon")
+	id, _ := store.Save(session, time.Now().Add(time.Hour))
+	loaded, _ := store.Load(id)
+	loaded.Rotate()
+	newID, _ := store.Save(loaded, time.Now().Add(time.Hour))
+	if newID == id {
+		t.Fatalf("rotation should change the id")
+	}
+	if old, _ := store.Load(id); old != nil {
+		t.Errorf("previous id should be deleted")
+	}
+	if current, _ := store.Load(newID); current == nil || !current.Get("user", new(string)) {
+		t.Errorf("rotated session should keep its values")
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	store := NewMemoryStore(0)
+	expired := New()
+	expired.Set("user", "old")
+	id, _ := store.Save(expired, time.Now().Add(-time.Second))
+	if s, _ := store.Load(id); s != nil {
+		t.Errorf("expired session should not load")
+	}
+	current := New()
+	current.Set("user", "new")
+	currentID, _ := store.Save(current, time.Now().Add(time.Hour))
+	if s, _ := store.Load(currentID); s == nil {
+		t.Fatalf("current session should load")
+	}
+	ms := store.(*memoryStore)
+	if _, ok := ms.sessions[id]; ok || len(ms.sessions) != 1 {
+		t.Errorf("expected expired sessions to be collected on save, got %d", len(ms.sessions))
+	}
+	if err := store.Delete(current); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := store.Load(currentID); s != nil {
+		t.Errorf("deleted session should not load")
+	}
+}
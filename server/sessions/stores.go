@@ -0,0 +1,230 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enolgor/go-utils-mm/cryp"
+)
+
+const maxCookieSize = 4096
+
+type cookieStore struct {
+	crypto cryp.Crypto
+	signer cryp.Signer
+}
+
+// NewCookieStore keeps the whole session in the cookie, encrypted with
+// blockKey (16, 24 or 32 bytes for AES) and authenticated with hashKey.
+func NewCookieStore(blockKey, hashKey []byte) Store {
+	if l := len(blockKey); l != 16 && l != 24 && l != 32 {
+		panic(fmt.Sprintf("invalid AES key size %d", l))
+	}
+	return &cookieStore{cryp.AES(blockKey), cryp.HMAC(hashKey)}
+}
+
+func (cs *cookieStore) Load(value string) (*Session, error) {
+	encrypted, err := cs.signer.Verify(value)
+	if err != nil {
+		return nil, nil
+	}
+	data, err := cs.crypto.Decrypt(string(encrypted))
+	if err != nil {
+		return nil, nil
+	}
+	return decode(data, time.Now())
+}
+
+func (cs *cookieStore) Save(session *Session, expires time.Time) (string, error) {
+	session.Expires = expires
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := cs.crypto.Encrypt(data)
+	if err != nil {
+		return "", err
+	}
+	value := cs.signer.Sign([]byte(encrypted))
+	if len(value) > maxCookieSize {
+		return "", fmt.Errorf("session cookie too large: %d bytes", len(value))
+	}
+	return value, nil
+}
+
+func (cs *cookieStore) Delete(session *Session) error {
+	return nil
+}
+
+type memoryEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+type memoryStore struct {
+	mu         sync.Mutex
+	sessions   map[string]memoryEntry
+	gcInterval time.Duration
+	lastGC     time.Time
+}
+
+func NewMemoryStore(gcInterval time.Duration) Store {
+	return &memoryStore{sessions: map[string]memoryEntry{}, gcInterval: gcInterval, lastGC: time.Now()}
+}
+
+func (ms *memoryStore) Load(value string) (*Session, error) {
+	ms.mu.Lock()
+	entry, ok := ms.sessions[value]
+	ms.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	return decode(entry.data, time.Now())
+}
+
+func (ms *memoryStore) Save(session *Session, expires time.Time) (string, error) {
+	session.Expires = expires
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if session.PreviousID() != "" {
+		delete(ms.sessions, session.PreviousID())
+	}
+	ms.sessions[session.ID] = memoryEntry{data, expires}
+	if now.Sub(ms.lastGC) > ms.gcInterval {
+		for id, entry := range ms.sessions {
+			if now.After(entry.expires) {
+				delete(ms.sessions, id)
+			}
+		}
+		ms.lastGC = now
+	}
+	return session.ID, nil
+}
+
+func (ms *memoryStore) Delete(session *Session) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.sessions, session.ID)
+	if session.PreviousID() != "" {
+		delete(ms.sessions, session.PreviousID())
+	}
+	return nil
+}
+
+type fileStore struct {
+	dir        string
+	mu         sync.Mutex
+	gcInterval time.Duration
+	lastGC     time.Time
+}
+
+// NewFileStore keeps one JSON file per session in dir, expired files are
+// removed every gcInterval.
+func NewFileStore(dir string, gcInterval time.Duration) (Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir, gcInterval: gcInterval, lastGC: time.Now()}, nil
+}
+
+func (fs *fileStore) file(id string) string {
+	return filepath.Join(fs.dir, id+".json")
+}
+
+func (fs *fileStore) Load(value string) (*Session, error) {
+	if !ValidID(value) {
+		return nil, nil
+	}
+	data, err := os.ReadFile(fs.file(value))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	session, err := decode(data, time.Now())
+	if session == nil && err == nil {
+		os.Remove(fs.file(value))
+	}
+	return session, err
+}
+
+func (fs *fileStore) Save(session *Session, expires time.Time) (string, error) {
+	session.Expires = expires
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	if session.PreviousID() != "" && ValidID(session.PreviousID()) {
+		os.Remove(fs.file(session.PreviousID()))
+	}
+	tmp, err := os.CreateTemp(fs.dir, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fs.file(session.ID))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	fs.gc()
+	return session.ID, nil
+}
+
+func (fs *fileStore) gc() {
+	fs.mu.Lock()
+	now := time.Now()
+	if now.Sub(fs.lastGC) <= fs.gcInterval {
+		fs.mu.Unlock()
+		return
+	}
+	fs.lastGC = now
+	fs.mu.Unlock()
+	entries, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(fs.dir, name))
+		if err != nil {
+			continue
+		}
+		if session, err := decode(data, now); session == nil || err != nil {
+			os.Remove(filepath.Join(fs.dir, name))
+		}
+	}
+}
+
+func (fs *fileStore) Delete(session *Session) error {
+	for _, id := range []string{session.ID, session.PreviousID()} {
+		if !ValidID(id) {
+			continue
+		}
+		if err := os.Remove(fs.file(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
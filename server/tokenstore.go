@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// RefreshToken is what a store keeps per issued refresh token. Tokens
+// rotated from the same login share a Family, so a reused token can revoke
+// every token derived from it.
+type RefreshToken struct {
+	ID        string
+	Family    string
+	Principal *Principal
+	Expires   time.Time
+	Used      bool
+}
+
+type TokenStore interface {
+	// SaveRefresh stores a newly issued refresh token.
+	SaveRefresh(token *RefreshToken) error
+	// UseRefresh atomically marks the token with id as used, returning it as
+	// it was before, or nil if unknown, revoked or expired.
+	UseRefresh(id string) (*RefreshToken, error)
+	// RevokeFamily invalidates every refresh token of family.
+	RevokeFamily(family string) error
+	// Revoke denies the access token with jti until it expires.
+	Revoke(jti string, expires time.Time) error
+	IsRevoked(jti string) (bool, error)
+}
+
+type memoryTokenStore struct {
+	mu        sync.Mutex
+	refresh   map[string]*RefreshToken
+	revoked   map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryTokenStore() TokenStore {
+	return &memoryTokenStore{refresh: map[string]*RefreshToken{}, revoked: map[string]time.Time{}, now: time.Now}
+}
+
+func (ms *memoryTokenStore) sweep(now time.Time) {
+	if now.Sub(ms.lastSweep) < time.Minute {
+		return
+	}
+	for id, token := range ms.refresh {
+		if now.After(token.Expires) {
+			delete(ms.refresh, id)
+		}
+	}
+	for jti, expires := range ms.revoked {
+		if now.After(expires) {
+			delete(ms.revoked, jti)
+		}
+	}
+	ms.lastSweep = now
+}
+
+func (ms *memoryTokenStore) SaveRefresh(token *RefreshToken) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sweep(ms.now())
+	saved := *token
+	ms.refresh[token.ID] = &saved
+	return nil
+}
+
+func (ms *memoryTokenStore) UseRefresh(id string) (*RefreshToken, error) {
+	now := ms.now()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	token, ok := ms.refresh[id]
+	if !ok || now.After(token.Expires) {
+		return nil, nil
+	}
+	before := *token
+	token.Used = true
+	return &before, nil
+}
+
+func (ms *memoryTokenStore) RevokeFamily(family string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for id, token := range ms.refresh {
+		if token.Family == family {
+			delete(ms.refresh, id)
+		}
+	}
+	return nil
+}
+
+func (ms *memoryTokenStore) Revoke(jti string, expires time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sweep(ms.now())
+	ms.revoked[jti] = expires
+	return nil
+}
+
+func (ms *memoryTokenStore) IsRevoked(jti string) (bool, error) {
+	now := ms.now()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	expires, ok := ms.revoked[jti]
+	return ok && !now.After(expires), nil
+}
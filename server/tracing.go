@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"github.com/enolgor/go-utils-mm/client/trace"
+)
+
+// Tracing starts a server span for every request, child of the traceparent
+// sent by the caller if any, and returns its traceparent in the response.
+// Requests sent with the client package using the request context carry the
+// span to the next service.
+func Tracing(tracer *trace.Tracer) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ctx := req.Context()
+			if remote, ok := trace.Extract(req.Header); ok {
+				ctx = trace.ContextWithRemote(ctx, remote)
+			}
+			ctx, span := tracer.Start(ctx, req.Method, trace.KindServer)
+			*req = *req.WithContext(ctx)
+			defer span.End()
+			span.SetAttribute("http.request.method", req.Method)
+			span.SetAttribute("url.path", req.URL.Path)
+			span.SetAttribute("client.address", ClientIP(req))
+			w.Header().Set(trace.TraceparentHeader, span.SpanContext().Traceparent())
+			rw := wrapResponseWriter(w)
+			next.ServeHTTP(rw, req)
+			if route := RouteExpr(req); route != "" {
+				span.Name = fmt.Sprintf("%s %s", req.Method, route)
+				span.SetAttribute("http.route", route)
+			}
+			span.SetAttribute("http.response.status_code", rw.Status())
+			if rw.Status() >= 500 {
+				span.SetStatus(trace.StatusError, http.StatusText(rw.Status()))
+			}
+		})
+	}
+}
+
+// Span returns the span of the request, or nil when the request didn't go
+// through the Tracing middleware.
+func Span(req *http.Request) *trace.Span {
+	return trace.SpanFromContext(req.Context())
+}
+
+// ClientTracing records a client span for each outgoing request made with
+// the client package and propagates it instead of the caller span.
+func ClientTracing(tracer *trace.Tracer) client.Interceptor {
+	return func(next client.Doer) client.Doer {
+		return func(req *http.Request) (*http.Response, error) {
+			ctx, span := tracer.Start(req.Context(), req.Method, trace.KindClient)
+			defer span.End()
+			req = req.WithContext(ctx)
+			trace.Inject(ctx, req.Header)
+			span.SetAttribute("http.request.method", req.Method)
+			span.SetAttribute("server.address", req.URL.Host)
+			span.SetAttribute("url.full", req.URL.Redacted())
+			resp, err := next(req)
+			if err != nil {
+				span.SetStatus(trace.StatusError, err.Error())
+				return resp, err
+			}
+			span.SetAttribute("http.response.status_code", resp.StatusCode)
+			if resp.StatusCode >= 400 {
+				span.SetStatus(trace.StatusError, http.StatusText(resp.StatusCode))
+			}
+			return resp, nil
+		}
+	}
+}
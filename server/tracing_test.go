@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/enolgor/go-utils-mm/client"
+	"github.com/enolgor/go-utils-mm/client/trace"
+)
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.Span
+}
+
+func (r *spanRecorder) Export(ctx context.Context, spans []*trace.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestTracingPropagation(t *testing.T) {
+	recorder := &spanRecorder{}
+	tracer := trace.NewTracer("test", recorder, trace.TracerOptions{})
+
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = req.Header.Get(trace.TraceparentHeader)
+	}))
+	defer upstream.Close()
+
+	router, err := NewRouterBuilder().
+		Use(Tracing(tracer)).
+		Get("/orders/:id", func(w http.ResponseWriter, req *http.Request) {
+			resp, err := client.Get(upstream.URL).WithContext(req.Context()).Do()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			Response(w).WithBody("ok").AsTextPlain()
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/orders/7", nil)
+	req.Header.Set(trace.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(trace.TracestateHeader, "vendor=abc")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.spans) != 1 {
+		t.Fatalf("expected one span, got %d", len(recorder.spans))
+	}
+	span := recorder.spans[0]
+	if span.Name != "GET /orders/:id" || span.ParentID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected span %s with parent %s", span.Name, span.ParentID)
+	}
+	if span.Attributes["http.response.status_code"] != http.StatusOK {
+		t.Fatalf("expected status attribute, got %v", span.Attributes)
+	}
+	sc, err := trace.ParseTraceparent(received)
+	if err != nil {
+		t.Fatalf("upstream got invalid traceparent %q", received)
+	}
+	if sc.TraceID != span.TraceID || sc.SpanID != span.SpanID {
+		t.Fatalf("expected upstream to be called from the server span, got %s", received)
+	}
+	if rec.Header().Get(trace.TraceparentHeader) != span.SpanContext().Traceparent() {
+		t.Fatal("expected the server span in the response")
+	}
+}
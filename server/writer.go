@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// responseWriter records the status and size of a response while keeping the
+// optional interfaces of the wrapped writer reachable.
+type responseWriter struct {
+	http.ResponseWriter
+	status       int
+	bytes        int64
+	beforeHeader []func()
+}
+
+func wrapResponseWriter(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w}
+}
+
+// onBeforeHeader registers fn to run once, right before the status is sent,
+// while headers can still be modified.
+func (rw *responseWriter) onBeforeHeader(fn func()) {
+	rw.beforeHeader = append(rw.beforeHeader, fn)
+}
+
+func (rw *responseWriter) runBeforeHeader() {
+	hooks := rw.beforeHeader
+	rw.beforeHeader = nil
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.runBeforeHeader()
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.runBeforeHeader()
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+func (rw *responseWriter) Status() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+// bufferingWriter is implemented by writers holding the response back, like
+// the one of ETag, so output that wasn't sent yet can be discarded.
+type bufferingWriter interface {
+	sent() bool
+	discard()
+}
+
+func (rw *responseWriter) buffering() bufferingWriter {
+	for w := rw.ResponseWriter; w != nil; {
+		if bw, ok := w.(bufferingWriter); ok {
+			return bw
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+	return nil
+}
+
+// Written reports if the response has started, output still held by a
+// buffering writer doesn't count.
+func (rw *responseWriter) Written() bool {
+	if rw.status == 0 {
+		return false
+	}
+	if bw := rw.buffering(); bw != nil {
+		return bw.sent()
+	}
+	return true
+}
+
+// discard drops a response that hasn't been sent so another one can be
+// written, it returns false when output already reached the client.
+func (rw *responseWriter) discard() bool {
+	if rw.Written() {
+		return false
+	}
+	if bw := rw.buffering(); bw != nil {
+		bw.discard()
+	}
+	rw.status, rw.bytes = 0, 0
+	return true
+}
+
+func (rw *responseWriter) Flush() {
+	if rw.status == 0 {
+		rw.runBeforeHeader()
+		rw.status = http.StatusOK
+	}
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := rw.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("%T does not support hijacking", rw.ResponseWriter)
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
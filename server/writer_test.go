@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/enolgor/go-utils-mm/client"
+)
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (hr *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hr.hijacked = true
+	return nil, nil, nil
+}
+
+func TestResponseWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := wrapResponseWriter(rec)
+	if wrapResponseWriter(rw) != rw {
+		t.Fatal("expected an existing wrapper to be reused")
+	}
+	var order []string
+	rw.onBeforeHeader(func() {
+		order = append(order, "first")
+		rw.Header().Set("X-Hook", "set")
+	})
+	rw.onBeforeHeader(func() { order = append(order, "second") })
+	if rw.Written() || rw.Status() != http.StatusOK {
+		t.Fatal("expected an unwritten response to default to 200")
+	}
+	rw.WriteHeader(http.StatusCreated)
+	rw.WriteHeader(http.StatusInternalServerError)
+	rw.Write([]byte("hello"))
+	rw.Write([]byte(" world"))
+	if strings.Join(order, ",") != "first,second" {
+		t.Errorf("expected hooks to run once in order, got %v", order)
+	}
+	if rw.Status() != http.StatusCreated || rw.bytes != 11 || !rw.Written() {
+		t.Errorf("expected status 201 and 11 bytes, got %d %d", rw.Status(), rw.bytes)
+	}
+	if rec.Header().Get("X-Hook") != "set" || rec.Code != http.StatusCreated {
+		t.Errorf("expected headers set by hooks to be sent, got %v", rec.Header())
+	}
+	if rw.Unwrap() != rec {
+		t.Error("expected Unwrap to return the wrapped writer")
+	}
+
+	rec = httptest.NewRecorder()
+	rw = wrapResponseWriter(rec)
+	ran := false
+	rw.onBeforeHeader(func() { ran = true })
+	rw.Flush()
+	if !ran || !rec.Flushed || rw.Status() != http.StatusOK {
+		t.Error("expected Flush to run the hooks, send the status and flush")
+	}
+
+	hr := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	if _, _, err := wrapResponseWriter(hr).Hijack(); err != nil || !hr.hijacked {
+		t.Error("expected Hijack to reach the wrapped writer")
+	}
+	if _, _, err := wrapResponseWriter(httptest.NewRecorder()).Hijack(); err == nil {
+		t.Error("expected an error when the wrapped writer can't hijack")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+	router, err := NewRouterBuilder().
+		Use(AccessLog(LogOptions{
+			Logger:       logger,
+			Headers:      []string{client.Authorization, client.UserAgent},
+			RedactFields: []string{"password"},
+		})).
+		Get("/users/:id", func(w http.ResponseWriter, req *http.Request) {
+			Logger(req).Info("handling", "password", "hunter2")
+			Response(w).Status(http.StatusAccepted).WithBody("done").AsTextPlain()
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/users/7", nil)
+	req.Header.Set(client.XRequestID, "upstream-id")
+	req.Header.Set(client.Authorization, "Bearer secret")
+	req.Header.Set(client.UserAgent, "test")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Header().Get(client.XRequestID) != "upstream-id" {
+		t.Errorf("expected the upstream request id to be propagated, got %q", rec.Header().Get(client.XRequestID))
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a handler and an access record, got %q", out.String())
+	}
+	var handling, access map[string]any
+	json.Unmarshal([]byte(lines[0]), &handling)
+	json.Unmarshal([]byte(lines[1]), &access)
+	if handling["request_id"] != "upstream-id" || handling["password"] != redacted {
+		t.Errorf("expected request attributes and redacted fields, got %v", handling)
+	}
+	headers, _ := access["headers"].(map[string]any)
+	if access["status"] != float64(http.StatusAccepted) || access["bytes"] != float64(4) || access["route"] != "/users/:id" ||
+		headers[client.Authorization] != redacted || headers[client.UserAgent] != "test" {
+		t.Errorf("unexpected access record %v", access)
+	}
+}